@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kargakis/chiapos/pkg/pos"
+	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
+)
+
+var (
+	plotPath      = flag.String("f", "plot.dat", "Path to the plot; more plots can be provided as arguments")
+	fsType        = flag.String("fs", fsutil.OsType, "Filesystem type")
+	numChallenges = flag.Int("n", 100, "Number of challenges to check the plot with")
+	seed          = flag.String("seed", "plotcheck", "Seed the challenges are derived from")
+	minRatio      = flag.Float64("min-ratio", 0.5, "Fraction of the expected proofs per challenge below which the plot is reported unhealthy")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [plot...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	plots := flag.Args()
+	if len(plots) == 0 {
+		plots = []string{*plotPath}
+	}
+
+	healthy := true
+	for _, plot := range plots {
+		if !check(plot) {
+			healthy = false
+		}
+	}
+	if !healthy {
+		os.Exit(1)
+	}
+}
+
+// check checks the plot found at plotPath and prints the outcome,
+// returning whether the plot is healthy.
+func check(plotPath string) bool {
+	fmt.Printf("Checking plot %s\n", plotPath)
+	result, err := pos.CheckPlot(plotPath, *fsType, *numChallenges, []byte(*seed))
+	if err != nil {
+		fmt.Printf("Cannot check plot: %v\n", err)
+		return false
+	}
+	fmt.Printf("Plot ID: %x\n", result.Header.ID)
+	fmt.Printf("k: %d\n", result.Header.K)
+	fmt.Printf("Proofs: %d out of %d challenges (ratio %.4f)\n", result.Proofs, result.Challenges, result.Ratio())
+	healthy := true
+	if expected := result.ExpectedRatio(); expected > 0 {
+		fmt.Printf("Expected ratio: %.4f\n", expected)
+		if result.Ratio() < *minRatio*expected {
+			fmt.Printf("Found far fewer proofs than expected; the plot may be missing entries\n")
+			healthy = false
+		}
+	}
+	for _, f := range result.Failures {
+		if f.Index < 0 {
+			fmt.Printf("Cannot look up proofs for challenge %x: %v\n", f.Challenge, f.Err)
+		} else {
+			fmt.Printf("Proof %d for challenge %x failed: %v\n", f.Index, f.Challenge, f.Err)
+		}
+	}
+	if len(result.Failures) > 0 {
+		fmt.Printf("%d proofs failed\n", len(result.Failures))
+		healthy = false
+	}
+	return healthy
+}
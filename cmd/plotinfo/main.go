@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kargakis/chiapos/pkg/pos"
+	"github.com/kargakis/chiapos/pkg/utils"
+	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
+)
+
+var (
+	plotPath = flag.String("f", "plot.dat", "Path to the plot; more plots can be provided as arguments")
+	fsType   = flag.String("fs", fsutil.OsType, "Filesystem type")
+	jsonOut  = flag.Bool("json", false, "Print the plot info as JSON")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [plot...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	plots := flag.Args()
+	if len(plots) == 0 {
+		plots = []string{*plotPath}
+	}
+
+	var infos []*pos.PlotInfo
+	for _, plot := range plots {
+		info, err := pos.Inspect(plot, *fsType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot inspect plot %s: %v\n", plot, err)
+			os.Exit(1)
+		}
+		infos = append(infos, info)
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		var err error
+		if len(infos) == 1 {
+			err = enc.Encode(infos[0])
+		} else {
+			err = enc.Encode(infos)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot encode plot info: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for i, info := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		printInfo(info)
+	}
+}
+
+// printInfo prints info in a human readable form.
+func printInfo(info *pos.PlotInfo) {
+	fmt.Printf("Plot: %s (%s)\n", info.Path, utils.PrettySize(float64(info.Size)))
+	version := info.Version
+	if version == "" {
+		version = "legacy"
+	}
+	fmt.Printf("Version: %s\n", version)
+	fmt.Printf("Plot ID: %s\n", info.ID)
+	fmt.Printf("k: %d\n", info.K)
+	if info.Memo != "" {
+		fmt.Printf("Memo: %s\n", info.Memo)
+	}
+	fmt.Printf("Format: %s (compressed: %t)\n", info.Format, info.Compressed)
+	fmt.Printf("Phase: %d\n", info.Phase)
+	fmt.Printf("Last table: %d (%d-%d)\n", info.LastTable, info.LastTableStart, info.LastTableEnd)
+	fmt.Printf("Complete: %t\n", info.Complete)
+	if len(info.Tables) == 0 {
+		return
+	}
+	fmt.Printf("%-5s %12s %12s %12s %12s\n", "Table", "Start", "End", "Size", "Entries")
+	for _, t := range info.Tables {
+		entries := fmt.Sprint(t.Entries)
+		if t.Entries < 0 {
+			entries = "-"
+		}
+		fmt.Printf("%-5s %12d %12d %12d %12s\n", t.Name, t.Start, t.End, t.Size, entries)
+	}
+}
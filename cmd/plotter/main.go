@@ -1,11 +1,14 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"syscall"
 	"time"
@@ -13,64 +16,97 @@ import (
 	"github.com/kargakis/chiapos/pkg/pos"
 	"github.com/kargakis/chiapos/pkg/utils"
 	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
+	sortutil "github.com/kargakis/chiapos/pkg/utils/sort"
 )
 
 var (
-	retry    = flag.Bool("retry", false, "If set to true, try to restore from a pre-existing plot")
-	k        = flag.Int("k", 18, "Storage parameter")
-	plotPath = flag.String("f", "plot.dat", "Path to the plot")
-	fsType   = flag.String("fs", fsutil.OsType, "Filesystem type")
-	keyPath  = flag.String("key", "", "Path to key to be used as a plot seed")
-	availMem = flag.Int("m", 5*1024*1024*1024, "Max memory to use when plotting. Defaults to all OS available memory when set to zero.")
+	retry        = flag.Bool("retry", false, "If set to true, try to restore from a pre-existing plot")
+	k            = flag.Int("k", 18, "Storage parameter")
+	plotPath     = flag.String("f", "plot.dat", "Name of the plot, written in the final directory")
+	tempDir      = flag.String("t", "", "Temporary directory the plot is written in until it is compressed. Defaults to the final directory")
+	tempDir2     = flag.String("2", "", "Second temporary directory the plot is compressed in. Defaults to the temporary directory")
+	finalDir     = flag.String("d", "", "Final directory the plot is moved in once it is complete. Defaults to the current directory")
+	fsType       = flag.String("fs", fsutil.OsType, "Filesystem type")
+	poolKey      = flag.String("pool-key", "", "Hex-encoded pool public key the plot id is derived from")
+	poolContract = flag.String("pool-contract", "", "Hex-encoded puzzle hash of the pool contract the plot id is derived from, instead of a pool public key")
+	plotKey      = flag.String("plot-key", "", "Hex-encoded plot public key the plot id is derived from")
+	memoHex      = flag.String("memo", "", "Hex-encoded memo to store in the plot header. Defaults to the pool key followed by the plot public key")
+	sortType     = flag.String("sort", sortutil.MergeStrategy, "Strategy used to sort tables that do not fit in memory (merge or bucket)")
+	availMem     = flag.Int("m", 5*1024*1024*1024, "Max memory to use when plotting. Defaults to all OS available memory when set to zero.")
+	threads      = flag.Int("threads", runtime.NumCPU(), "Number of threads used to compute the tables")
+	buckets      = flag.Int("buckets", 0, "Number of buckets tables are sorted in with the bucket strategy. Needs to be a power of two; picked based on the available memory when set to zero.")
 )
 
-func retrieveKey(keyPath, plotPath string, retry bool) ([]byte, error) {
-	var key []byte
-	var err error
-
+// plotIdentity returns the id of the plot and the memo to store in its
+// header. When retrying, the id is read from the pre-existing plot that
+// is found at plotPath in the filesystem of type fsType while it is being
+// written.
+func plotIdentity(poolKey, poolContract, plotKey, memoHex, plotPath, fsType string, retry bool) ([]byte, []byte, error) {
 	if retry {
-		// Try to retrieve key from pre-existing plot
-		fmt.Printf("Reading seed from pre-existing plot at %s...\n", plotPath)
-		key, err = pos.GetKey(plotPath)
-	} else if keyPath == "" {
-		// If a key is not provided, generate one in random
-		fmt.Println("Generating seed...")
-		key = make([]byte, utils.KeyLen)
-		_, err = rand.Read(key)
-		if err == nil {
-			err = ioutil.WriteFile(".seed", key, 0600)
-		}
-	} else {
-		fmt.Printf("Reading seed from %s...\n", keyPath)
-		key, err = ioutil.ReadFile(keyPath)
-		if err == nil {
-			key = utils.NormalizeKey(key)
-		}
+		fmt.Printf("Reading plot id from pre-existing plot at %s...\n", plotPath)
+		id, err := pos.GetKey(plotPath, fsType)
+		return id, nil, err
 	}
 
-	return key, err
-}
+	if (poolKey == "") == (poolContract == "") {
+		return nil, nil, errors.New("exactly one of -pool-key or -pool-contract is required")
+	}
+	pool, err := hex.DecodeString(poolKey + poolContract)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pool key: %w", err)
+	}
+	if poolKey != "" && len(pool) != pos.PoolPublicKeySize {
+		return nil, nil, fmt.Errorf("pool public key is %d bytes; needs to be %d", len(pool), pos.PoolPublicKeySize)
+	}
+	if poolContract != "" && len(pool) != pos.PoolContractPuzzleHashSize {
+		return nil, nil, fmt.Errorf("pool contract puzzle hash is %d bytes; needs to be %d", len(pool), pos.PoolContractPuzzleHashSize)
+	}
 
-func gc() {
-	for {
-		select {
-		case <-time.Tick(10 * time.Second):
-			// TODO: Run this only we actually need to manually
-			// free up memory instead of every 10 seconds.
-			runtime.GC()
+	if plotKey == "" {
+		return nil, nil, errors.New("-plot-key is required")
+	}
+	plotPublicKey, err := hex.DecodeString(plotKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid plot public key: %w", err)
+	}
+	id, err := pos.PlotID(pool, plotPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The plot id can always be derived again out of the default memo.
+	memo := append(pool, plotPublicKey...)
+	if memoHex != "" {
+		memo, err = hex.DecodeString(memoHex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid memo: %w", err)
 		}
 	}
+	return id, memo, nil
 }
 
 func main() {
 	flag.Parse()
 
-	key, err := retrieveKey(*keyPath, *plotPath, *retry)
+	options := []pos.PlotOption{
+		pos.WithFsType(*fsType),
+		pos.WithTempDir(*tempDir),
+		pos.WithTempDir2(*tempDir2),
+		pos.WithFinalDir(*finalDir),
+	}
+	resumePath, err := pos.NewPlotter(options...).ResumePath(*plotPath)
 	if err != nil {
-		fmt.Printf("cannot set up plot seed: %v", err)
+		fmt.Printf("cannot set up plot id: %v\n", err)
 		os.Exit(1)
 	}
 
+	id, memo, err := plotIdentity(*poolKey, *poolContract, *plotKey, *memoHex, resumePath, *fsType, *retry)
+	if err != nil {
+		fmt.Printf("cannot set up plot id: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Plot ID: %x\n", id)
+
 	if *availMem == 0 && runtime.GOOS != "windows" {
 		si := &syscall.Sysinfo_t{}
 		if err := syscall.Sysinfo(si); err != nil {
@@ -79,15 +115,29 @@ func main() {
 		}
 		*availMem = int(si.Freeram)
 	}
-	// TODO: Re-enable when sort on disk is finalized
-	// https://github.com/kargakis/chiapos/issues/5
-	// fmt.Printf("Available memory: %dMB\n", *availMem/(1024*1024))
+	fmt.Printf("Available memory: %dMB\n", *availMem/(1024*1024))
+
+	// Stop plotting at the next safe point on interrupt so
+	// the plot can be resumed with -retry.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// run GC manually to flush unused memory as quickly as possible
-	go gc()
+	plotter := pos.NewPlotter(append(options,
+		pos.WithSortStrategy(*sortType),
+		pos.WithBuckets(*buckets),
+		pos.WithMemory(*availMem),
+		pos.WithThreads(*threads),
+		pos.WithMemo(memo),
+		pos.WithRetry(*retry),
+		pos.WithLogger(log.New(os.Stdout, "", 0)),
+	)...)
 
 	plotStart := time.Now()
-	wrote, err := pos.PlotDisk(*plotPath, *fsType, *k, *availMem, key[:], *retry)
+	wrote, err := plotter.Plot(ctx, *plotPath, *k, id)
+	if errors.Is(err, context.Canceled) {
+		fmt.Printf("Plotting interrupted after %v; run again with -retry to resume\n", time.Since(plotStart))
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Printf("cannot write plot: %v\n", err)
 		os.Exit(1)
@@ -3,26 +3,56 @@ package main
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/kargakis/chiapos/pkg/pos"
 	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
 )
 
 var (
-	c        = flag.String("c", "", "Challenge to use for the space proof")
+	c        = flag.String("c", "", "Hex-encoded 32-byte challenge to use for the space proof; defaults to a random challenge persisted in .random_challenge")
 	plotPath = flag.String("f", "plot.dat", "Path to the plot")
 	fsType   = flag.String("fs", fsutil.OsType, "Filesystem type")
+	all      = flag.Bool("all", false, "Print all the space proofs found for the challenge")
+	values   = flag.Bool("values", false, "Print the comma-separated x values of space proofs instead of packing them in hex")
 )
 
+// qualityCommand prints the quality strings of all the space
+// proofs found for the challenge instead of the proofs.
+const qualityCommand = "quality"
+
 func main() {
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [%s] [flags]\n", os.Args[0], qualityCommand)
+		flag.PrintDefaults()
+	}
 
-	challenge := []byte(*c)
-	if len(challenge) == 0 {
+	var command string
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if command != "" && command != qualityCommand {
+		fmt.Printf("Unknown command %q\n", command)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var challenge []byte
+	if *c != "" {
+		parsed, err := pos.ParseChallenge(*c)
+		if err != nil {
+			fmt.Printf("Cannot use challenge: %v\n", err)
+			os.Exit(1)
+		}
+		challenge = parsed[:]
+	} else {
 		challenge = make([]byte, 32)
 		if _, err := rand.Read(challenge); err != nil {
 			fmt.Printf("Cannot generate random challenge: %v\n", err)
@@ -31,15 +61,42 @@ func main() {
 		h := sha256.New()
 		h.Write(challenge)
 		challenge = h.Sum(nil)
-		// fmt.Printf("Using random challenge %x\n", challenge)
-		if err := ioutil.WriteFile(".random_challenge", challenge, 0600); err != nil {
+		if err := ioutil.WriteFile(".random_challenge", []byte(hex.EncodeToString(challenge)), 0600); err != nil {
 			fmt.Printf("Cannot persist random challenge: %v\n", err)
 			os.Exit(1)
 		}
 	}
-	if len(challenge) != 32 {
-		fmt.Printf("Challenge is %d bytes; needs to be 32\n", len(challenge))
-		os.Exit(1)
+
+	if command == qualityCommand {
+		qualities, err := pos.GetQualitiesForChallenge(*plotPath, *fsType, challenge)
+		if err != nil {
+			fmt.Printf("Cannot read plot: %v\n", err)
+			os.Exit(1)
+		}
+		if len(qualities) == 0 {
+			fmt.Println("No space proof exists for the challenge")
+			os.Exit(1)
+		}
+		for _, quality := range qualities {
+			fmt.Printf("%x\n", quality)
+		}
+		return
+	}
+
+	if *all {
+		proofs, err := pos.ProveAll(*plotPath, *fsType, challenge)
+		if err != nil {
+			fmt.Printf("Cannot read plot: %v\n", err)
+			os.Exit(1)
+		}
+		if len(proofs) == 0 {
+			fmt.Println("No space proof exists for the challenge")
+			os.Exit(1)
+		}
+		for _, proof := range proofs {
+			printProof(proof)
+		}
+		return
 	}
 
 	proof, err := pos.Prove(*plotPath, *fsType, challenge)
@@ -47,5 +104,19 @@ func main() {
 		fmt.Printf("Cannot read plot: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Println(proof)
+	printProof(proof)
+}
+
+// printProof prints the proof packed in hex, or its x values.
+func printProof(proof pos.SpaceProof) {
+	if *values {
+		fmt.Println(proof)
+		return
+	}
+	text, err := proof.MarshalText()
+	if err != nil {
+		fmt.Printf("Cannot pack space proof: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(text))
 }
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
@@ -10,54 +16,267 @@ import (
 
 	"github.com/kargakis/chiapos/pkg/pos"
 	"github.com/kargakis/chiapos/pkg/utils"
+	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
 )
 
 var (
-	c       = flag.String("c", "", "Challenge to use for the space proof")
-	k       = flag.Int("k", 18, "Space parameter")
-	keyPath = flag.String("key", "", "Path to the plot seed")
-	proof   = flag.String("p", "", "Space proof")
+	c         = flag.String("c", "", "Hex-encoded 32-byte challenge to use for the space proof")
+	k         = flag.Int("k", 0, "Space parameter; defaults to the k of the plot provided via -plot, or the size of packed proofs")
+	keyPath   = flag.String("key", "", "Path to the plot seed")
+	id        = flag.String("id", "", "Hex-encoded plot id, instead of a path to the plot seed")
+	plotPath  = flag.String("plot", "", "Path to a plot to read the plot id and k from, instead of a path to the plot seed")
+	fsType    = flag.String("fs", fsutil.OsType, "Filesystem type of the plot provided via -plot")
+	proof     = flag.String("p", "", "Space proof, either as comma-separated x values or hex-encoded with k bits per x value")
+	proofPath = flag.String("pf", "", "Path to a file with one space proof per line, or a single binary proof, instead of -p; use - to read from the standard input")
+	jsonOut   = flag.Bool("json", false, "Print the verdict as JSON")
+	legacy    = flag.Bool("legacy", false, "Verify proofs of a legacy plot, created before the plot header got versioned; set already for legacy plots provided via -plot")
 )
 
+// verdict is the outcome of verifying space proofs, as printed with -json.
+type verdict struct {
+	Valid     bool           `json:"valid"`
+	PlotID    string         `json:"plotId,omitempty"`
+	K         int            `json:"k,omitempty"`
+	Challenge string         `json:"challenge,omitempty"`
+	Proofs    []proofVerdict `json:"proofs,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// proofVerdict is the outcome of verifying a single space proof.
+type proofVerdict struct {
+	Proof   string `json:"proof"`
+	Valid   bool   `json:"valid"`
+	Quality string `json:"quality,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
 func main() {
 	flag.Parse()
 
-	seed, err := ioutil.ReadFile(*keyPath)
+	v, err := verify()
 	if err != nil {
-		fmt.Printf("Cannot set up plot seed: %v\n", err)
+		v.Error = err.Error()
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	} else if err != nil {
+		fmt.Printf("Cannot verify space proof: %v\n", err)
+	} else {
+		for i, p := range v.Proofs {
+			switch {
+			case p.Valid && len(v.Proofs) == 1:
+				fmt.Println("The provided space proof is valid.")
+			case p.Valid:
+				fmt.Printf("Space proof %d is valid.\n", i)
+			case len(v.Proofs) == 1:
+				fmt.Printf("Cannot verify space proof: %s\n", p.Error)
+			default:
+				fmt.Printf("Cannot verify space proof %d: %s\n", i, p.Error)
+			}
+		}
+	}
+	if !v.Valid {
 		os.Exit(1)
 	}
-	seed = utils.NormalizeKey(seed)
+}
+
+// verify verifies all the space proofs provided, and returns whether they
+// are all valid. An error is returned if the proofs cannot be verified at all.
+func verify() (*verdict, error) {
+	v := &verdict{}
+	seed, err := readPlotID()
+	if err != nil {
+		return v, fmt.Errorf("cannot set up plot seed: %w", err)
+	}
+	v.PlotID = hex.EncodeToString(seed)
 
 	if *c == "" {
-		fmt.Println("Challenge cannot be empty")
-		os.Exit(1)
+		return v, errors.New("challenge cannot be empty")
+	}
+	challenge, err := pos.ParseChallenge(*c)
+	if err != nil {
+		return v, err
 	}
+	v.Challenge = hex.EncodeToString(challenge[:])
 
-	if *proof == "" {
-		fmt.Println("Space proof cannot be empty")
-		os.Exit(1)
+	proofs, err := readProofs()
+	if err != nil {
+		return v, err
+	}
+	if len(proofs) == 0 {
+		return v, errors.New("space proof cannot be empty")
 	}
 
-	proofStrings := strings.Split(*proof, ",")
-	if len(proofStrings) != 64 {
-		fmt.Printf("Invalid space proof: expected 64 values, got %d\n", len(proofStrings))
-		os.Exit(1)
+	if *k == 0 {
+		for _, p := range proofs {
+			if p.proof.K != 0 {
+				*k = p.proof.K
+				break
+			}
+		}
+	}
+	for _, p := range proofs {
+		if *k == 0 && p.err == nil {
+			return v, errors.New("space parameter is required to verify x values; provide -k or -plot")
+		}
 	}
+	v.K = *k
 
-	var proofs []uint64
-	for _, p := range proofStrings {
-		pi, err := strconv.Atoi(strings.TrimRight(p, ","))
+	var plotID [32]byte
+	copy(plotID[:], seed)
+	v.Valid = true
+	for _, p := range proofs {
+		pv := proofVerdict{Proof: p.text}
+		var quality []byte
+		xs, err := p.values(*k)
+		switch {
+		case err != nil:
+		case *legacy:
+			// Proofs of legacy plots only verify with the f
+			// functions the plot got created with.
+			if err = pos.VerifyLegacy(string(challenge[:]), seed, *k, xs); err == nil {
+				quality, err = pos.GetQuality(challenge[:], *k, xs)
+			}
+		default:
+			var packed []byte
+			if packed, err = pos.PackProof(xs, *k); err == nil {
+				quality, err = pos.VerifyProof(plotID, uint8(*k), challenge, packed)
+			}
+		}
 		if err != nil {
-			fmt.Printf("Invalid space proof (%s): %v\n", *proof, err)
-			os.Exit(1)
+			pv.Error = err.Error()
+			v.Valid = false
+		} else {
+			pv.Valid = true
+			pv.Quality = hex.EncodeToString(quality)
 		}
-		proofs = append(proofs, uint64(pi))
+		v.Proofs = append(v.Proofs, pv)
 	}
+	return v, nil
+}
 
-	if err := pos.Verify(*c, seed, *k, proofs); err != nil {
-		fmt.Printf("Cannot verify space proof: %v\n", err)
-		os.Exit(1)
+// readPlotID returns the plot id provided via -plot, -id or -key, and sets k
+// to the k of the plot provided via -plot unless it is set already, and
+// legacy if the plot is a legacy plot.
+func readPlotID() ([]byte, error) {
+	if *plotPath != "" {
+		h, err := pos.ReadPlotHeader(*plotPath, *fsType)
+		if err != nil {
+			return nil, err
+		}
+		if *k == 0 {
+			*k = h.K
+		} else if *k != h.K {
+			return nil, fmt.Errorf("k=%d does not match k=%d of plot %s", *k, h.K, *plotPath)
+		}
+		*legacy = *legacy || h.Legacy()
+		return h.ID, nil
+	}
+	if *id != "" {
+		seed, err := hex.DecodeString(*id)
+		if err == nil && len(seed) != utils.KeyLen {
+			err = fmt.Errorf("plot id is %d bytes; needs to be %d", len(seed), utils.KeyLen)
+		}
+		return seed, err
+	}
+	seed, err := ioutil.ReadFile(*keyPath)
+	return utils.NormalizeKey(seed), err
+}
+
+// proofInput is a space proof as provided, either as x values or packed.
+type proofInput struct {
+	// text is the proof as provided, or hex-encoded for binary proofs.
+	text string
+	// proof is the parsed proof. Its k is the k packed proofs got packed
+	// with, found out of their size, and zero for proofs provided as x
+	// values.
+	proof pos.SpaceProof
+	// err is set if the proof cannot be parsed.
+	err error
+}
+
+// values returns the x values of the proof.
+func (p proofInput) values(k int) ([]uint64, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.proof.K != 0 && p.proof.K != k {
+		return nil, fmt.Errorf("invalid space proof: packed for k=%d, not k=%d", p.proof.K, k)
+	}
+	return p.proof.X, nil
+}
+
+// readProofs reads the space proofs provided via -p or -pf.
+func readProofs() ([]proofInput, error) {
+	if *proofPath == "" {
+		if *proof == "" {
+			return nil, nil
+		}
+		return []proofInput{parseProof(*proof)}, nil
+	}
+
+	var data []byte
+	var err error
+	if *proofPath == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*proofPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read space proofs: %w", err)
+	}
+	if !isText(data) {
+		p := proofInput{text: hex.EncodeToString(data)}
+		p.err = p.proof.UnmarshalBinary(data)
+		return []proofInput{p}, nil
+	}
+
+	var proofs []proofInput
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			proofs = append(proofs, parseProof(line))
+		}
+	}
+	return proofs, scanner.Err()
+}
+
+// isText reports whether data holds proofs in text,
+// rather than a single proof in binary.
+func isText(data []byte) bool {
+	for _, b := range data {
+		if !strings.ContainsRune("0123456789abcdefABCDEF, \t\r\n", rune(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseProof parses a proof made of comma-separated x values,
+// or a hex-encoded packed proof.
+func parseProof(s string) proofInput {
+	p := proofInput{text: s}
+	if !strings.Contains(s, ",") {
+		p.err = p.proof.UnmarshalText([]byte(s))
+		return p
+	}
+
+	proofStrings := strings.Split(strings.TrimRight(s, ","), ",")
+	if len(proofStrings) != 64 {
+		p.err = fmt.Errorf("invalid space proof: expected 64 values, got %d", len(proofStrings))
+		return p
+	}
+	for _, x := range proofStrings {
+		xi, err := strconv.ParseUint(strings.TrimSpace(x), 10, 64)
+		if err != nil {
+			p.err = fmt.Errorf("invalid space proof: %w", err)
+			return p
+		}
+		p.proof.X = append(p.proof.X, xi)
 	}
-	fmt.Println("The provided space proof is valid.")
+	return p
 }
@@ -0,0 +1,170 @@
+package encoding
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// ANSScaleBits is the precision of the symbol frequencies
+	// used by the ANS coder.
+	ANSScaleBits = 12
+	// ansTotal is the sum of all symbol frequencies.
+	ansTotal = 1 << ANSScaleBits
+	// ansLow is the lower bound of the coder state.
+	ansLow = 1 << 23
+	// ansStateSize is the size in bytes of the flushed coder state.
+	ansStateSize = 4
+)
+
+// ANS is a static range asymmetric numeral systems (rANS) coder
+// for byte symbols. The same frequencies need to be used both for
+// encoding and decoding.
+type ANS struct {
+	freqs  [256]uint32
+	starts [256]uint32
+	// symbols maps every slot in [0, ansTotal) to its symbol.
+	symbols [ansTotal]byte
+}
+
+// NewANS returns a coder for the provided symbol frequencies. There
+// should be a frequency for every possible symbol, and all frequencies
+// should add up to 1<<ANSScaleBits.
+func NewANS(freqs []uint32) (*ANS, error) {
+	if len(freqs) != 256 {
+		return nil, fmt.Errorf("expected 256 frequencies, got %d", len(freqs))
+	}
+	a := &ANS{}
+	var start uint32
+	for s, f := range freqs {
+		if start+f > ansTotal {
+			return nil, fmt.Errorf("frequencies add up to more than %d", ansTotal)
+		}
+		a.freqs[s] = f
+		a.starts[s] = start
+		for i := start; i < start+f; i++ {
+			a.symbols[i] = byte(s)
+		}
+		start += f
+	}
+	if start != ansTotal {
+		return nil, fmt.Errorf("frequencies add up to %d, expected %d", start, ansTotal)
+	}
+	return a, nil
+}
+
+// NormalizeFrequencies scales the provided symbol counts so they add up
+// to 1<<ANSScaleBits. Every symbol that got counted ends up with a non-zero
+// frequency so it can be encoded.
+func NormalizeFrequencies(counts []uint64) ([]uint32, error) {
+	var total uint64
+	for _, c := range counts {
+		total += c
+	}
+	freqs := make([]uint32, len(counts))
+	if total == 0 {
+		// Nothing to encode, but the frequencies still need to be valid.
+		freqs[0] = ansTotal
+		return freqs, nil
+	}
+
+	var sum, largest int
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		f := uint32(c * ansTotal / total)
+		if f == 0 {
+			f = 1
+		}
+		freqs[s] = f
+		sum += int(f)
+		if freqs[s] > freqs[largest] {
+			largest = s
+		}
+	}
+
+	// Rounding leaves the sum off by a bit so correct it by
+	// adjusting the frequencies of the most frequent symbols.
+	for sum != ansTotal {
+		if sum < ansTotal {
+			freqs[largest] += uint32(ansTotal - sum)
+			sum = ansTotal
+			break
+		}
+		largest = 0
+		for s := range freqs {
+			if freqs[s] > freqs[largest] {
+				largest = s
+			}
+		}
+		if freqs[largest] <= 1 {
+			return nil, errors.New("too many symbols to normalize frequencies")
+		}
+		excess := uint32(sum - ansTotal)
+		if excess > freqs[largest]-1 {
+			excess = freqs[largest] - 1
+		}
+		freqs[largest] -= excess
+		sum -= int(excess)
+	}
+	return freqs, nil
+}
+
+// Encode encodes the provided symbols.
+func (a *ANS) Encode(symbols []byte) ([]byte, error) {
+	// rANS works like a stack so symbols are encoded in reverse
+	// and so is the output, so the decoder can read it forward.
+	var out []byte
+	state := uint32(ansLow)
+	for i := len(symbols) - 1; i >= 0; i-- {
+		s := symbols[i]
+		freq := a.freqs[s]
+		if freq == 0 {
+			return nil, fmt.Errorf("cannot encode symbol %d with zero frequency", s)
+		}
+		max := ((ansLow >> ANSScaleBits) << 8) * freq
+		for state >= max {
+			out = append(out, byte(state))
+			state >>= 8
+		}
+		state = (state/freq)<<ANSScaleBits + state%freq + a.starts[s]
+	}
+	for i := 0; i < ansStateSize; i++ {
+		out = append(out, byte(state))
+		state >>= 8
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
+
+// Decode decodes n symbols out of the provided data.
+func (a *ANS) Decode(data []byte, n int) ([]byte, error) {
+	if len(data) < ansStateSize {
+		return nil, errors.New("not enough data to decode")
+	}
+	var state uint32
+	for _, b := range data[:ansStateSize] {
+		state = state<<8 | uint32(b)
+	}
+	data = data[ansStateSize:]
+
+	symbols := make([]byte, n)
+	for i := range symbols {
+		slot := state & (ansTotal - 1)
+		s := a.symbols[slot]
+		symbols[i] = s
+		state = a.freqs[s]*(state>>ANSScaleBits) + slot - a.starts[s]
+		for state < ansLow {
+			if len(data) == 0 {
+				return nil, errors.New("not enough data to decode")
+			}
+			state = state<<8 | uint32(data[0])
+			data = data[1:]
+		}
+	}
+	return symbols, nil
+}
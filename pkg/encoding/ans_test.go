@@ -0,0 +1,82 @@
+package encoding
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestANS(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		name    string
+		symbols func() byte
+	}{
+		{
+			name:    "geometric",
+			symbols: func() byte { return byte(r.ExpFloat64() * 3) },
+		},
+		{
+			name:    "uniform",
+			symbols: func() byte { return byte(r.Intn(256)) },
+		},
+		{
+			name:    "single symbol",
+			symbols: func() byte { return 7 },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			symbols := make([]byte, 2047)
+			counts := make([]uint64, 256)
+			for i := range symbols {
+				symbols[i] = test.symbols()
+				counts[symbols[i]]++
+			}
+
+			freqs, err := NormalizeFrequencies(counts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for s, c := range counts {
+				if c > 0 && freqs[s] == 0 {
+					t.Fatalf("symbol %d got a zero frequency", s)
+				}
+			}
+			ans, err := NewANS(freqs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encoded, err := ans.Encode(symbols)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := ans.Decode(encoded, len(symbols))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(symbols, decoded) {
+				t.Fatal("decoded symbols differ from the encoded ones")
+			}
+		})
+	}
+}
+
+func TestANSUnknownSymbol(t *testing.T) {
+	counts := make([]uint64, 256)
+	counts[1] = 10
+	freqs, err := NormalizeFrequencies(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ans, err := NewANS(freqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ans.Encode([]byte{1, 2}); err == nil {
+		t.Fatal("expected an error when encoding a symbol with zero frequency")
+	}
+}
@@ -0,0 +1,78 @@
+package encoding
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// LinePoint is a 128-bit unsigned integer that encodes a pair of
+// values. Pairs of positions or x values can need up to 2k+2 bits
+// to be encoded which does not fit in a uint64 for large k.
+type LinePoint struct {
+	Hi, Lo uint64
+}
+
+// SquareToLinePoint encodes the unordered pair of the distinct values x
+// and y into a single line point. If we think of x and y as coordinates
+// in a square, pairs are enumerated line by line in the triangle under
+// the diagonal, hence the name.
+func SquareToLinePoint(x, y uint64) LinePoint {
+	if x < y {
+		x, y = y, x
+	}
+	// x * (x-1) / 2 + y, where either x or x-1 is even.
+	a, b := x, x-1
+	if a%2 == 0 {
+		a /= 2
+	} else {
+		b /= 2
+	}
+	hi, lo := bits.Mul64(a, b)
+	lo, carry := bits.Add64(lo, y, 0)
+	return LinePoint{Hi: hi + carry, Lo: lo}
+}
+
+// LinePointToSquare decodes a line point back into the pair of values
+// it was created from. The larger value of the pair is returned first.
+func LinePointToSquare(lp LinePoint) (uint64, uint64) {
+	// x is the largest number such that x*(x-1)/2 <= lp, which
+	// is floor((1 + sqrt(1 + 8*lp)) / 2).
+	l := lp.Big()
+	root := new(big.Int).Lsh(l, 3)
+	root.Add(root, big.NewInt(1))
+	root.Sqrt(root)
+	root.Add(root, big.NewInt(1))
+	x := root.Rsh(root, 1).Uint64()
+
+	base := SquareToLinePoint(x, 0)
+	return x, lp.Lo - base.Lo
+}
+
+// Less reports whether lp is smaller than o.
+func (lp LinePoint) Less(o LinePoint) bool {
+	if lp.Hi != o.Hi {
+		return lp.Hi < o.Hi
+	}
+	return lp.Lo < o.Lo
+}
+
+// Delta returns lp-prev, where prev is not larger than lp. The boolean
+// result reports whether the difference fits in a uint64.
+func (lp LinePoint) Delta(prev LinePoint) (uint64, bool) {
+	lo, borrow := bits.Sub64(lp.Lo, prev.Lo, 0)
+	hi, _ := bits.Sub64(lp.Hi, prev.Hi, borrow)
+	return lo, hi == 0
+}
+
+// Add returns lp+delta.
+func (lp LinePoint) Add(delta uint64) LinePoint {
+	lo, carry := bits.Add64(lp.Lo, delta, 0)
+	return LinePoint{Hi: lp.Hi + carry, Lo: lo}
+}
+
+// Big returns lp as a big.Int.
+func (lp LinePoint) Big() *big.Int {
+	l := new(big.Int).SetUint64(lp.Hi)
+	l.Lsh(l, 64)
+	return l.Or(l, new(big.Int).SetUint64(lp.Lo))
+}
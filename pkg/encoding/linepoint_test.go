@@ -0,0 +1,66 @@
+package encoding
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+func TestLinePoint(t *testing.T) {
+	tests := []struct {
+		x, y uint64
+	}{
+		{x: 1, y: 0},
+		{x: 0, y: 1},
+		{x: 2, y: 1},
+		{x: 1 << 16, y: 1<<16 - 1},
+		{x: 1<<60 - 1, y: 1<<60 - 2},
+		{x: 1 << 60, y: 0},
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		tests = append(tests, struct{ x, y uint64 }{x: r.Uint64() >> 4, y: r.Uint64() >> 4})
+	}
+
+	for _, test := range tests {
+		if test.x == test.y {
+			continue
+		}
+		lp := SquareToLinePoint(test.x, test.y)
+
+		x, y := test.x, test.y
+		if x < y {
+			x, y = y, x
+		}
+		// x * (x-1) / 2 + y
+		expected := new(big.Int).SetUint64(x)
+		expected.Mul(expected, new(big.Int).SetUint64(x-1))
+		expected.Rsh(expected, 1)
+		expected.Add(expected, new(big.Int).SetUint64(y))
+		if lp.Big().Cmp(expected) != 0 {
+			t.Fatalf("expected line point of (%d, %d) to be %v, got %v", x, y, expected, lp.Big())
+		}
+
+		gotX, gotY := LinePointToSquare(lp)
+		if gotX != x || gotY != y {
+			t.Fatalf("expected (%d, %d), got (%d, %d)", x, y, gotX, gotY)
+		}
+	}
+}
+
+func TestLinePointDelta(t *testing.T) {
+	prev := LinePoint{Hi: 1, Lo: 1<<64 - 10}
+	next := prev.Add(20)
+	if next != (LinePoint{Hi: 2, Lo: 10}) {
+		t.Fatalf("unexpected sum: %+v", next)
+	}
+	if !prev.Less(next) || next.Less(prev) {
+		t.Fatalf("expected %+v to be smaller than %+v", prev, next)
+	}
+	if delta, ok := next.Delta(prev); !ok || delta != 20 {
+		t.Fatalf("expected delta 20, got %d (fits: %t)", delta, ok)
+	}
+	if _, ok := (LinePoint{Hi: 3}).Delta(prev); ok {
+		t.Fatal("expected delta not to fit in 64 bits")
+	}
+}
@@ -0,0 +1,158 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// Metadata is a 256-bit unsigned integer that holds the collated value an
+// entry passes on to the next table. Collated values need up to 4k bits,
+// which does not fit in a LinePoint for large k. Words are stored least
+// significant first.
+type Metadata [4]uint64
+
+// NewMetadata returns x as metadata.
+func NewMetadata(x uint64) Metadata {
+	return Metadata{x}
+}
+
+// MetadataFromBytes returns the big-endian number in b as metadata, similar
+// to big.Int.SetBytes. Any bytes beyond the least significant 32 are ignored.
+func MetadataFromBytes(b []byte) Metadata {
+	var m Metadata
+	for i := 0; i < len(b) && i < 32; i++ {
+		m[i/8] |= uint64(b[len(b)-1-i]) << (8 * (i % 8))
+	}
+	return m
+}
+
+// MetadataFromBlock returns the 16-byte block b, such as the output of
+// an AES encryption, as metadata.
+func MetadataFromBlock(b []byte) Metadata {
+	return Metadata{binary.BigEndian.Uint64(b[8:16]), binary.BigEndian.Uint64(b[:8])}
+}
+
+// MetadataFromBig returns x as metadata. Any bits beyond
+// the least significant 256 are ignored.
+func MetadataFromBig(x *big.Int) Metadata {
+	return MetadataFromBytes(x.Bytes())
+}
+
+// Bytes returns m as a big-endian byte slice without any leading
+// zero bytes, similar to big.Int.Bytes.
+func (m Metadata) Bytes() []byte {
+	buf := make([]byte, 32)
+	for i, w := range m {
+		binary.BigEndian.PutUint64(buf[24-8*i:], w)
+	}
+	return buf[32-(m.BitLen()+7)/8:]
+}
+
+// Block returns the AES block m is encrypted as. Metadata is encrypted by
+// left-padding its big-endian bytes to a multiple of the block size, which
+// makes the first block either the least significant 128 bits of m, or the
+// most significant 128 bits when m does not fit in a single block.
+func (m Metadata) Block() [16]byte {
+	hi, lo := m[1], m[0]
+	if m[2] != 0 || m[3] != 0 {
+		hi, lo = m[3], m[2]
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], hi)
+	binary.BigEndian.PutUint64(b[8:], lo)
+	return b
+}
+
+// Big returns m as a big.Int.
+func (m Metadata) Big() *big.Int {
+	return new(big.Int).SetBytes(m.Bytes())
+}
+
+// Uint64 returns the least significant 64 bits of m.
+func (m Metadata) Uint64() uint64 {
+	return m[0]
+}
+
+// BitLen returns the length of m in bits.
+func (m Metadata) BitLen() int {
+	for i := len(m) - 1; i >= 0; i-- {
+		if m[i] != 0 {
+			return 64*i + bits.Len64(m[i])
+		}
+	}
+	return 0
+}
+
+// Lsh returns m<<n. Bits shifted beyond the 256th bit are dropped.
+func (m Metadata) Lsh(n uint) Metadata {
+	var r Metadata
+	words, shift := int(n/64), n%64
+	for i := len(m) - 1; i >= words; i-- {
+		r[i] = m[i-words] << shift
+		if shift > 0 && i > words {
+			r[i] |= m[i-words-1] >> (64 - shift)
+		}
+	}
+	return r
+}
+
+// Rsh returns m>>n.
+func (m Metadata) Rsh(n uint) Metadata {
+	var r Metadata
+	words, shift := int(n/64), n%64
+	for i := 0; i+words < len(m); i++ {
+		r[i] = m[i+words] >> shift
+		if shift > 0 && i+words+1 < len(m) {
+			r[i] |= m[i+words+1] << (64 - shift)
+		}
+	}
+	return r
+}
+
+// Add returns m+o. Any carry beyond the 256th bit is dropped.
+func (m Metadata) Add(o Metadata) Metadata {
+	var r Metadata
+	var carry uint64
+	for i := range m {
+		r[i], carry = bits.Add64(m[i], o[i], carry)
+	}
+	return r
+}
+
+// Xor returns m^o.
+func (m Metadata) Xor(o Metadata) Metadata {
+	for i := range m {
+		m[i] ^= o[i]
+	}
+	return m
+}
+
+// Concat returns m shifted k bits to the left plus o, which is the
+// zero-padded concatenation of m and o when o fits in k bits.
+func (m Metadata) Concat(k int, o Metadata) Metadata {
+	return m.Lsh(uint(k)).Add(o)
+}
+
+// Trunc returns the b most significant bits of m, where m belongs to
+// [2^k]. If a is non-zero then the ath to (b-1)th bits of m are returned.
+func (m Metadata) Trunc(a, b, k int) Metadata {
+	m = m.Rsh(uint(k - b))
+	if a > 0 {
+		m = m.mask(b - a)
+	}
+	return m
+}
+
+// mask returns the n least significant bits of m.
+func (m Metadata) mask(n int) Metadata {
+	for i := range m {
+		switch {
+		case n <= 64*i:
+			m[i] = 0
+		case n < 64*(i+1):
+			m[i] &= 1<<uint(n-64*i) - 1
+		}
+	}
+	return m
+}
@@ -0,0 +1,79 @@
+package encoding
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/kargakis/chiapos/pkg/utils"
+)
+
+func randomBig(r *rand.Rand, maxBits int) *big.Int {
+	n := new(big.Int).Lsh(big.NewInt(1), uint(r.Intn(maxBits+1)))
+	return n.Rand(r, n)
+}
+
+func TestMetadata(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	mod := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	for i := 0; i < 2000; i++ {
+		x, y := randomBig(r, 256), randomBig(r, 256)
+		mx, my := MetadataFromBig(x), MetadataFromBig(y)
+		n := uint(r.Intn(257))
+
+		if got := mx.Big(); got.Cmp(x) != 0 {
+			t.Fatalf("expected %x, got %x", x, got)
+		}
+		if got := mx.Bytes(); !bytes.Equal(got, x.Bytes()) {
+			t.Fatalf("%x: expected bytes %x, got %x", x, x.Bytes(), got)
+		}
+		if got := mx.BitLen(); got != x.BitLen() {
+			t.Fatalf("%x: expected bit length %d, got %d", x, x.BitLen(), got)
+		}
+		expected := new(big.Int).Lsh(x, n)
+		if got := mx.Lsh(n).Big(); got.Cmp(expected.Mod(expected, mod)) != 0 {
+			t.Fatalf("%x<<%d: expected %x, got %x", x, n, expected, got)
+		}
+		if got := mx.Rsh(n).Big(); got.Cmp(new(big.Int).Rsh(x, n)) != 0 {
+			t.Fatalf("%x>>%d: expected %x, got %x", x, n, new(big.Int).Rsh(x, n), got)
+		}
+		expected = new(big.Int).Add(x, y)
+		if got := mx.Add(my).Big(); got.Cmp(expected.Mod(expected, mod)) != 0 {
+			t.Fatalf("%x+%x: expected %x, got %x", x, y, expected, got)
+		}
+		if got := mx.Xor(my).Big(); got.Cmp(new(big.Int).Xor(x, y)) != 0 {
+			t.Fatalf("%x^%x: expected %x, got %x", x, y, new(big.Int).Xor(x, y), got)
+		}
+
+		// Truncate k-bit numbers the way plotting does.
+		k := 1 + r.Intn(256)
+		x, y = randomBig(r, k), randomBig(r, k)
+		mx = MetadataFromBig(x)
+		b := 1 + r.Intn(k)
+		a := r.Intn(b)
+		expected = utils.Trunc(new(big.Int).Set(x), a, b, k)
+		if got := mx.Trunc(a, b, k).Big(); got.Cmp(expected) != 0 {
+			t.Fatalf("trunc(%x, %d, %d, %d): expected %x, got %x", x, a, b, k, expected, got)
+		}
+
+		// Concatenate numbers that fit in 256 bits.
+		concatBits := r.Intn(129)
+		x, y = randomBig(r, 128), randomBig(r, 128)
+		expected = new(big.Int).Add(new(big.Int).Lsh(x, uint(concatBits)), y)
+		if got := MetadataFromBig(x).Concat(concatBits, MetadataFromBig(y)).Big(); got.Cmp(expected) != 0 {
+			t.Fatalf("concat(%x, %x, %d): expected %x, got %x", x, y, concatBits, expected, got)
+		}
+
+		// Blocks match the first block of the padded bytes.
+		x = randomBig(r, 256)
+		block := MetadataFromBig(x).Block()
+		if padded := utils.FillToBlock(x.Bytes()); !bytes.Equal(block[:], padded[:16]) {
+			t.Fatalf("%x: expected block %x, got %x", x, padded[:16], block)
+		}
+		if got := MetadataFromBlock(block[:]).Big(); got.Cmp(new(big.Int).SetBytes(block[:])) != 0 {
+			t.Fatalf("%x: expected %x from block, got %x", block, new(big.Int).SetBytes(block[:]), got)
+		}
+	}
+}
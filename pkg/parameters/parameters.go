@@ -12,9 +12,26 @@ const (
 	ParamC  = 509
 	ParamBC = ParamB * ParamC
 
+	// ParamOffsetSize is the number of bits used to store the offset between
+	// the left and the right match of an entry. Matches are always found in
+	// adjacent BC groups so the offset is bounded by the number of entries in
+	// two BC groups.
+	ParamOffsetSize = 12
+
 	// ParamC1 defines how many entries to checkpoint from the last table
 	// to enable fast lookups.
 	ParamC1 = 10000
+	// ParamC2 defines how many entries to checkpoint from the C1 table,
+	// so the C2 table is small enough to be loaded in memory.
+	ParamC2 = 10000
+
+	// ParamEntriesPerPark defines how many line points are stored in
+	// every park of a compressed table.
+	ParamEntriesPerPark = 2048
+	// ParamStubMinusBits defines how many bits shorter than the average
+	// delta between consecutive line points the stubs of a park are. The
+	// remaining, most significant, bits of every delta are entropy-coded.
+	ParamStubMinusBits = 3
 
 	// Space parameters controlling the plot size.
 
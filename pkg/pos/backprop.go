@@ -0,0 +1,160 @@
+package pos
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+)
+
+// prunedPlotSuffix is appended to the plot path to name the
+// file pruned tables get written in during backpropagation.
+const prunedPlotSuffix = ".backprop"
+
+// Backpropagate is Phase 2 of the plotter. During this phase, tables are walked
+// from the last one back to the first one, and every entry that is not used by
+// any entry of the next table is dropped since it cannot be part of a proof of
+// space. Positions of the remaining entries are rewritten to point to the pruned
+// tables. Pruned tables are written in a new file that replaces the plot once
+// all tables are pruned, so the plot file is returned along with the total
+// number of bytes written in it. If ctx is cancelled, the plot is kept along
+// with the tables pruned so far, and ctx.Err() is returned. Every step is reported
+// to progress, unless it is nil.
+func Backpropagate(ctx context.Context, fs afero.Fs, file afero.File, k int, retry bool, progress Progress) (afero.File, int, error) {
+	h, err := ParsePlotHeader(file)
+	if err != nil {
+		return file, 0, err
+	}
+	if h.LastTable != 7 {
+		return file, 0, fmt.Errorf("cannot backpropagate plot with %d tables", h.LastTable)
+	}
+	pointers := h.Tables
+
+	numEntries := countEntries(k, pointers, h.LastTableEnd)
+
+	used, err := markUsedEntries(ctx, file, k, pointers, numEntries, progress)
+	if err != nil {
+		return file, 0, err
+	}
+
+	prunedPath := file.Name() + prunedPlotSuffix
+	pruned, lastIndex, tableStart, err := openPhasePlot(fs, file, k, prunedPath, backpropagationPhase, retry, progress)
+	if err != nil {
+		return file, 0, err
+	}
+
+	wrote := tableStart - 1
+	for t := lastIndex + 1; t <= 7; t++ {
+		if err := ctx.Err(); err != nil {
+			pruned.Close()
+			return file, wrote, err
+		}
+		tWrote, err := pruneTable(ctx, file, pruned, k, t, pointers[t-1], numEntries[t], tableStart, used, progress)
+		if err != nil {
+			pruned.Close()
+			return file, wrote, err
+		}
+		if err := updateLastTableIndexAndPositions(pruned, t, tableStart, tableStart+tWrote); err != nil {
+			pruned.Close()
+			return file, wrote, err
+		}
+		wrote = tableStart + tWrote
+		tableStart += tWrote + 1
+	}
+
+	plot, err := replacePlot(fs, file, pruned)
+	return plot, wrote, err
+}
+
+// countEntries returns how many entries every table of the plot holds,
+// indexed by table, given the start of every table and the end of the
+// last table. Tables are written one after the other, each followed by
+// an EOT entry.
+func countEntries(k int, pointers []int, lastTableEnd int) []int {
+	numEntries := make([]int, 8)
+	for t := 1; t <= 7; t++ {
+		end := lastTableEnd
+		if t < 7 {
+			end = pointers[t] - 1
+		}
+		numEntries[t] = (end-pointers[t-1])/serialize.EntrySize(k, t) - 1
+	}
+	return numEntries
+}
+
+// markUsedEntries walks all tables from the last one back to the second one
+// and marks the entries of the previous table that are used by entries of
+// the current table that are in use themselves. All entries of the last
+// table are in use. The returned bitfields are indexed by table.
+func markUsedEntries(ctx context.Context, file afero.File, k int, pointers, numEntries []int, progress Progress) ([]*bitfield, error) {
+	used := make([]*bitfield, 8)
+	for t := 1; t <= 6; t++ {
+		used[t] = newBitfield(numEntries[t])
+	}
+
+	for t := 7; t > 1; t-- {
+		tr := track(progress, backpropagationPhase, t, StepMark, numEntries[t])
+		err := readTable(ctx, file, pointers[t-1], numEntries[t], k, t, func(i uint64, e *serialize.Entry) error {
+			if i%readCheckInterval == 0 {
+				tr.update(int(i), 0, 0)
+			}
+			if t < 7 && !used[t].isSet(i) {
+				return nil
+			}
+			left, right := *e.Pos, *e.Pos+*e.Offset
+			if right >= uint64(numEntries[t-1]) {
+				return fmt.Errorf("entry %d of table %d points outside of table %d", i, t, t-1)
+			}
+			used[t-1].set(left)
+			used[t-1].set(right)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		tr.done(numEntries[t], 0, 0)
+	}
+
+	for t := 1; t <= 6; t++ {
+		used[t].buildRanks()
+	}
+	return used, nil
+}
+
+// pruneTable writes all the used entries of table t found in src at srcStart
+// in dst at dstStart. Positions and offsets are rewritten so they point to
+// the pruned previous table. The total number of bytes written, including
+// EOT, is returned.
+func pruneTable(ctx context.Context, src, dst afero.File, k, t, srcStart, numEntries, dstStart int, used []*bitfield, progress Progress) (int, error) {
+	var kept int
+	tr := track(progress, backpropagationPhase, t, StepPrune, numEntries)
+	ew := serialize.NewEntryWriter(dst, int64(dstStart), k, t)
+	err := readTable(ctx, src, srcStart, numEntries, k, t, func(i uint64, e *serialize.Entry) error {
+		if i%readCheckInterval == 0 {
+			tr.update(int(i), kept, int(ew.Offset())-dstStart)
+		}
+		if t < 7 && !used[t].isSet(i) {
+			return nil
+		}
+		if t > 1 {
+			left := used[t-1].index(*e.Pos)
+			offset := used[t-1].index(*e.Pos+*e.Offset) - left
+			e.Pos, e.Offset = &left, &offset
+		}
+		kept++
+		return ew.Write(e)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := ew.WriteEOT(); err != nil {
+		return 0, err
+	}
+	if err := ew.Flush(); err != nil {
+		return 0, err
+	}
+	tr.done(numEntries, kept, int(ew.Offset())-dstStart)
+	return int(ew.Offset()) - dstStart, nil
+}
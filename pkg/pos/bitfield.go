@@ -0,0 +1,51 @@
+package pos
+
+import "math/bits"
+
+// bitfield keeps track of the entries of a table that are
+// used by entries of the next table.
+type bitfield struct {
+	bits []uint64
+	// ranks holds the number of bits set before every word
+	// and is populated by buildRanks.
+	ranks []uint64
+}
+
+func newBitfield(size int) *bitfield {
+	return &bitfield{bits: make([]uint64, (size+63)/64)}
+}
+
+func (b *bitfield) set(i uint64) {
+	b.bits[i/64] |= 1 << (i % 64)
+}
+
+func (b *bitfield) isSet(i uint64) bool {
+	return b.bits[i/64]&(1<<(i%64)) != 0
+}
+
+// count returns the number of bits set.
+func (b *bitfield) count() int {
+	var count int
+	for _, word := range b.bits {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// buildRanks prepares the bitfield for index lookups. It should be
+// called once all bits are set.
+func (b *bitfield) buildRanks() {
+	b.ranks = make([]uint64, len(b.bits))
+	var rank uint64
+	for i, word := range b.bits {
+		b.ranks[i] = rank
+		rank += uint64(bits.OnesCount64(word))
+	}
+}
+
+// index returns the number of bits set before i, ie. the position
+// of entry i in its table once all unset entries are dropped.
+func (b *bitfield) index(i uint64) uint64 {
+	mask := uint64(1)<<(i%64) - 1
+	return b.ranks[i/64] + uint64(bits.OnesCount64(b.bits[i/64]&mask))
+}
@@ -0,0 +1,29 @@
+package pos
+
+import "testing"
+
+func TestBitfield(t *testing.T) {
+	b := newBitfield(200)
+	set := []uint64{0, 3, 63, 64, 65, 127, 128, 199}
+	for _, i := range set {
+		b.set(i)
+	}
+	b.buildRanks()
+
+	if got := b.count(); got != len(set) {
+		t.Fatalf("expected %d bits set, got %d", len(set), got)
+	}
+	for index, i := range set {
+		if !b.isSet(i) {
+			t.Fatalf("expected bit %d to be set", i)
+		}
+		if got := b.index(i); got != uint64(index) {
+			t.Fatalf("expected index of bit %d to be %d, got %d", i, index, got)
+		}
+	}
+	for _, i := range []uint64{1, 62, 66, 198} {
+		if b.isSet(i) {
+			t.Fatalf("expected bit %d to be unset", i)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package pos
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// CheckFailure is a space proof of a plot that could not be
+// retrieved or failed to verify.
+type CheckFailure struct {
+	// Challenge is the challenge the proof was looked up for.
+	Challenge []byte
+	// Index is the index of the proof among the proofs the plot
+	// holds for the challenge, or -1 if they could not be looked up.
+	Index int
+	// Proof is the proof, if it could be retrieved.
+	Proof SpaceProof
+	// Err is why the proof failed.
+	Err error
+}
+
+// CheckResult is the outcome of checking a plot.
+type CheckResult struct {
+	// Header is the header of the plot.
+	Header *PlotHeader
+	// Challenges is the number of challenges the plot got checked with.
+	Challenges int
+	// Proofs is the number of proofs found for all challenges,
+	// including the ones that failed.
+	Proofs int
+	// Outputs is the number of outputs in table 7, or 0 for legacy
+	// plots, which do not track where table 7 ends.
+	Outputs int
+	// Failures holds all the proofs that failed.
+	Failures []CheckFailure
+}
+
+// Ratio returns the number of proofs found per challenge.
+func (r *CheckResult) Ratio() float64 {
+	if r.Challenges == 0 {
+		return 0
+	}
+	return float64(r.Proofs) / float64(r.Challenges)
+}
+
+// ExpectedRatio returns the number of proofs expected per challenge. Every
+// output of table 7 matches a challenge with probability 2^-k, so a healthy
+// plot holds about as many proofs per challenge as it has outputs over 2^k.
+// It is 0 if the number of outputs is unknown.
+func (r *CheckResult) ExpectedRatio() float64 {
+	return float64(r.Outputs) / float64(uint64(1)<<r.Header.K)
+}
+
+// CheckChallenge returns the i-th challenge plots are checked with
+// for the provided seed, which is the sha256 hash of the seed followed
+// by i as a big-endian 32-bit integer.
+func CheckChallenge(seed []byte, i int) []byte {
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(i))
+	h := sha256.New()
+	h.Write(seed)
+	h.Write(index[:])
+	return h.Sum(nil)
+}
+
+// CheckPlot checks the health of the plot found at plotPath. The header is
+// validated, and every proof the plot holds for numChallenges challenges
+// derived from seed is retrieved and verified against the plot id and k in
+// the header. Proofs that cannot be retrieved or verified are reported as
+// failures in the result, while an error is returned if the plot cannot be
+// read at all.
+func CheckPlot(plotPath, fsType string, numChallenges int, seed []byte) (*CheckResult, error) {
+	plot, err := openPlotReader(plotPath, fsType)
+	if err != nil {
+		return nil, err
+	}
+	defer plot.file.Close()
+
+	info, err := plot.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateHeader(plot.header, info.Size()); err != nil {
+		return nil, fmt.Errorf("invalid plot header: %w", err)
+	}
+
+	outputs, err := plot.numOutputs(info.Size())
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{Header: plot.header, Challenges: numChallenges, Outputs: outputs}
+	for i := 0; i < numChallenges; i++ {
+		challenge := CheckChallenge(seed, i)
+		matches, _, err := plot.findMatches(challenge)
+		if err != nil {
+			result.Failures = append(result.Failures, CheckFailure{Challenge: challenge, Index: -1, Err: err})
+			continue
+		}
+		for j, match := range matches {
+			result.Proofs++
+			proof, err := plot.getFullProof(match)
+			if err == nil {
+				err = verify(string(challenge), plot.id, plot.k, proof.X, plot.header.Legacy())
+			}
+			if err != nil {
+				result.Failures = append(result.Failures, CheckFailure{Challenge: challenge, Index: j, Proof: proof, Err: err})
+			}
+		}
+	}
+	return result, nil
+}
+
+// numOutputs returns the number of outputs in table 7 of the plot, which is
+// size bytes long. Legacy plots do not track where table 7 ends, so 0 is
+// returned for them.
+func (p *plotReader) numOutputs(size int64) (int, error) {
+	if p.header.Legacy() {
+		return 0, nil
+	}
+	table, err := inspectTable(p.file, p.header, 7, size)
+	if err != nil {
+		return 0, err
+	}
+	return table.Entries, nil
+}
+
+// validateHeader checks that the tables of a complete plot that is size
+// bytes long are found one after the other after the header.
+func validateHeader(h *PlotHeader, size int64) error {
+	if int64(h.LastTableEnd) > size {
+		return fmt.Errorf("last table ends at %d, after the end of the plot at %d", h.LastTableEnd, size)
+	}
+	if h.Legacy() {
+		// Legacy plots do not track where every table starts.
+		return nil
+	}
+	previous := h.Size
+	for t := 1; t <= h.LastTable; t++ {
+		start := h.Tables[t-1]
+		if start <= previous {
+			return fmt.Errorf("table %d starts at %d, before the end of the previous table at %d", t, start, previous)
+		}
+		previous = start
+	}
+	if h.LastTableStart != h.Tables[h.LastTable-1] || h.LastTableEnd < h.LastTableStart {
+		return fmt.Errorf("last table spans from %d to %d, but starts at %d", h.LastTableStart, h.LastTableEnd, h.Tables[h.LastTable-1])
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package pos
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPlot(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+	seed := []byte("seed")
+	numChallenges := 3000
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+
+	opts := PlotOptions{AvailableMemory: 1 << 30, Threads: 2, Logger: log.New(io.Discard, "", 0)}
+	if _, err := PlotDisk(context.Background(), plotPath, k, id, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CheckPlot(plotPath, "os", numChallenges, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Header.ID, id) || result.Header.K != k {
+		t.Errorf("expected plot id %x and k=%d, got %x and k=%d", id, k, result.Header.ID, result.Header.K)
+	}
+	if result.Challenges != numChallenges {
+		t.Errorf("expected %d challenges, got %d", numChallenges, result.Challenges)
+	}
+	if result.Proofs == 0 {
+		t.Fatalf("expected proofs for %d challenges", numChallenges)
+	}
+	// Every challenge matches about Outputs/2^k outputs of table 7, give
+	// or take a few percent over that many challenges.
+	expected := result.ExpectedRatio()
+	if expected == 0 {
+		t.Fatalf("expected the number of outputs in table 7, got %d", result.Outputs)
+	}
+	// C3 holds every output of table 7 of compressed plots.
+	info, err := Inspect(plotPath, "os")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 := info.Tables[c3Table-1].Entries; result.Outputs != c3 {
+		t.Errorf("expected %d outputs in table 7, got %d", c3, result.Outputs)
+	}
+	if ratio := result.Ratio(); math.Abs(ratio-expected) > expected/5 {
+		t.Errorf("expected about %.4f proofs per challenge, got %.4f", expected, ratio)
+	}
+	if len(result.Failures) > 0 {
+		t.Fatalf("expected no failed proofs, got %d: %v", len(result.Failures), result.Failures[0].Err)
+	}
+
+	// Corrupt table 1, which holds the x values of every proof.
+	data, err := os.ReadFile(plotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := result.Header.Tables[0]; i < result.Header.Tables[1]; i++ {
+		data[i] ^= 0xff
+	}
+	if err := os.WriteFile(plotPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	corrupted, err := CheckPlot(plotPath, "os", numChallenges, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted.Failures) == 0 {
+		t.Errorf("expected proofs of a corrupted plot to fail")
+	}
+
+	// Truncate the plot before the end of the last table.
+	if err := os.Truncate(plotPath, int64(result.Header.LastTableEnd-1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckPlot(plotPath, "os", numChallenges, seed); err == nil {
+		t.Errorf("expected truncated plot to fail the header validation")
+	}
+}
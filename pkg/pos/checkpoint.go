@@ -1,67 +1,93 @@
 package pos
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"io"
 
 	"github.com/spf13/afero"
 
+	"github.com/kargakis/chiapos/pkg/encoding"
 	"github.com/kargakis/chiapos/pkg/parameters"
 	"github.com/kargakis/chiapos/pkg/serialize"
-	"github.com/kargakis/chiapos/pkg/utils"
 )
 
-// Checkpoint reads the last table in the plot and creates a new
-// table where it stores checkpoints to the last table so fast
-// retrieval of proofs can be enabled by reading the checkpoints.
-// TODO: Create checkpoint table C2 to checkpoint C1.
-func Checkpoint(file afero.File, k int) (int, error) {
-	fmt.Println("Starting checkpointing...")
-	var wrote int
-
-	_, start, end, err := getLastTableIndexAndPositions(file)
-	if err != nil {
-		return wrote, err
-	}
+// Indexes of the checkpoint tables, which are written after table 7.
+const (
+	// c1Table holds every ParamC1-th output of table 7
+	// along with its position in table 7.
+	c1Table = serialize.CheckpointTable
+	// c2Table holds every ParamC2-th entry of C1 along
+	// with its position in C1.
+	c2Table = c1Table + 1
+	// c3Table holds all the outputs of table 7 in parks,
+	// one for every entry of C1.
+	c3Table = c2Table + 1
+)
 
-	var bytesRead, read, count int
-	var entry *serialize.Entry
-	entryLen := serialize.EntrySize(k, 7)
-	for {
-		// Create checkpoints of the last table every C1 entries
-		entry, bytesRead, err = serialize.Read(file, int64(start+read), entryLen, k)
-		if errors.Is(err, serialize.EOTErr) || errors.Is(err, io.EOF) {
-			break
+// Checkpoint writes the checkpoint tables of table 7 in dst, after the table
+// with index lastIndex which ends right before dstStart. Outputs of table 7 are
+// read from the table found at srcStart in src. Since table 7 is sorted by
+// output, proofs can be looked up by loading C2 in memory, seeking into C1,
+// and decoding the single park of C3 where the outputs matching a challenge
+// are found. Outputs are streamed from src while writing every checkpoint table,
+// so they do not need to fit in memory. Where the last checkpoint table ends in
+// dst is returned. If ctx is cancelled, the checkpoint tables written so far are
+// kept and ctx.Err() is returned. Every table written is reported to progress,
+// unless it is nil.
+func Checkpoint(ctx context.Context, src, dst afero.File, k, srcStart, numEntries, lastIndex, dstStart int, progress Progress) (int, error) {
+	wrote := dstStart - 1
+	for t := lastIndex + 1; t <= c3Table; t++ {
+		if err := ctx.Err(); err != nil {
+			return wrote, err
+		}
+		tr := track(progress, compressionPhase, t, StepCheckpoint, 0)
+		var tWrote int
+		var err error
+		switch t {
+		case c1Table:
+			tWrote, err = writeCheckpoints(ctx, src, dst, k, srcStart, numEntries, dstStart, parameters.ParamC1, 1)
+		case c2Table:
+			tWrote, err = writeCheckpoints(ctx, src, dst, k, srcStart, numEntries, dstStart, parameters.ParamC1*parameters.ParamC2, parameters.ParamC1)
+		case c3Table:
+			tWrote, err = serialize.WriteCheckpointParksFrom(dst, int64(dstStart), k, func(fn func(encoding.LinePoint) error) error {
+				return readTable(ctx, src, srcStart, numEntries, k, 7, func(_ uint64, e *serialize.Entry) error {
+					return fn(encoding.LinePoint{Lo: e.Fx})
+				})
+			})
 		}
 		if err != nil {
-			return wrote, fmt.Errorf("cannot read left entry: %w", err)
+			return wrote, fmt.Errorf("cannot write checkpoint table C%d: %w", t-7, err)
 		}
-
-		if count%parameters.ParamC1 == 0 {
-			// Write down the exact position of the checkpointed entry in the plot.
-			pos := uint64(start + read)
-			w, err := serialize.Write(file, int64(end+1+wrote), entry.Fx, nil, &pos, nil, nil, k)
-			if err != nil {
-				return wrote + w, err
-			}
-			wrote += w
+		if err := updateLastTableIndexAndPositions(dst, t, dstStart, dstStart+tWrote); err != nil {
+			return wrote, err
 		}
-		count++
-		read += bytesRead
+		wrote = dstStart + tWrote
+		dstStart += tWrote + 1
+		tr.done(0, 0, tWrote)
 	}
+	return wrote, nil
+}
 
-	eotBytes, err := WriteEOT(file, entryLen)
+// writeCheckpoints writes every interval-th output of the table 7 found at
+// srcStart in src in dst at dstStart, along with its position divided by unit,
+// followed by EOT. The total number of bytes written is returned.
+func writeCheckpoints(ctx context.Context, src, dst afero.File, k, srcStart, numEntries, dstStart, interval, unit int) (int, error) {
+	ew := serialize.NewEntryWriter(dst, int64(dstStart), k, serialize.CheckpointTable)
+	err := readTable(ctx, src, srcStart, numEntries, k, 7, func(i uint64, e *serialize.Entry) error {
+		if i%uint64(interval) != 0 {
+			return nil
+		}
+		pos := i / uint64(unit)
+		return ew.Write(&serialize.Entry{Fx: e.Fx, Pos: &pos})
+	})
 	if err != nil {
-		return wrote + eotBytes, err
+		return 0, err
 	}
-	wrote += eotBytes
-
-	// TODO: Set a different index than 8, change index to a string
-	if err := updateLastTableIndexAndPositions(file, 8, end+1, end+1+wrote); err != nil {
-		return wrote, err
+	if err := ew.WriteEOT(); err != nil {
+		return 0, err
 	}
-	fmt.Printf("Finished checkpointing (wrote %s)\n", utils.PrettySize(float64(wrote)))
-
-	return wrote, nil
+	if err := ew.Flush(); err != nil {
+		return 0, err
+	}
+	return int(ew.Offset()) - dstStart, nil
 }
@@ -1,22 +1,22 @@
 package pos
 
 import (
-	"math/big"
+	"fmt"
 
-	"github.com/kargakis/chiapos/pkg/utils"
+	"github.com/kargakis/chiapos/pkg/encoding"
 )
 
 // Collate collates left and right inputs into outputs for the next table.
-func Collate(t, k int, l, r *big.Int) (*big.Int, error) {
+func Collate(t, k int, l, r encoding.Metadata) (encoding.Metadata, error) {
 	switch t {
 	case 2:
-		return utils.ConcatBig(k, l, r), nil
+		return l.Concat(k, r), nil
 
 	case 3:
-		return utils.ConcatBig(2*k, l, r), nil
+		return l.Concat(2*k, r), nil
 
 	case 4:
-		return new(big.Int).Xor(l, r), nil
+		return l.Xor(r), nil
 
 	case 5:
 		// TODO: When bytes are deserialized to a primitive such as int or big.Int
@@ -25,8 +25,8 @@ func Collate(t, k int, l, r *big.Int) (*big.Int, error) {
 		//if l.BitLen()%4 != 0 {
 		//	return nil, fmt.Errorf("invalid bit length for output %d, expected bit_len%%4==0", l.BitLen())
 		//}
-		tmp := new(big.Int).Xor(l, r)
-		return utils.Trunc(tmp, 0, tmp.BitLen()*3/4, tmp.BitLen()), nil
+		tmp := l.Xor(r)
+		return tmp.Trunc(0, tmp.BitLen()*3/4, tmp.BitLen()), nil
 
 	case 6:
 		// TODO: When bytes are deserialized to a primitive such as int or big.Int
@@ -35,8 +35,8 @@ func Collate(t, k int, l, r *big.Int) (*big.Int, error) {
 		//if l.BitLen()%3 != 0 {
 		//	return nil, fmt.Errorf("invalid bit length for output %d, expected bit_len%%3==0", l.BitLen())
 		//}
-		tmp := new(big.Int).Xor(l, r)
-		return utils.Trunc(tmp, 0, tmp.BitLen()*2/3, tmp.BitLen()), nil
+		tmp := l.Xor(r)
+		return tmp.Trunc(0, tmp.BitLen()*2/3, tmp.BitLen()), nil
 	}
-	return nil, nil
+	return encoding.Metadata{}, fmt.Errorf("cannot collate outputs of table %d", t)
 }
@@ -0,0 +1,386 @@
+package pos
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
+	"github.com/kargakis/chiapos/pkg/serialize"
+	"github.com/kargakis/chiapos/pkg/utils/sort"
+)
+
+// compressedPlotSuffix is appended to the plot path to name the
+// file compressed tables get written in during compression.
+const compressedPlotSuffix = ".compress"
+
+// Suffixes appended to the path of the compressed plot to name
+// the temporary files line points get sorted in.
+const (
+	pointersSuffix   = ".pointers"
+	linePointsSuffix = ".linepoints"
+	positionsSuffix  = ".positions"
+)
+
+// Compress is Phase 3 of the plotter. During this phase, the positions every
+// entry points to in the previous table are converted into a single line point.
+// Entries of every table are sorted by line point, and their line points are
+// stored in parks, where deltas between consecutive line points get compressed.
+// Everything else can be dropped from tables 1-6 since proofs can be retrieved by
+// walking down line points to the x values. Table 7 only keeps the position of
+// the line point of every entry in table 6, while its outputs are moved to the
+// checkpoint tables that are written after it.
+//
+// Table t of the compressed plot holds the line points of the entries of table
+// t+1, where line points of table 1 are made of x values. Line points, and the
+// positions they end up at, are sorted on disk within the available memory in
+// opts, in temporary files next to the compressed plot. Compressed tables are
+// written in a new file in opts.TempDir2, or next to the plot when it is empty,
+// which is returned once all tables are compressed along with the total number
+// of bytes written in it. The plot is left in place, so it is up to the caller
+// to replace it. If ctx is cancelled, the plot is kept along with the tables
+// compressed so far, and ctx.Err() is returned. Every step is reported to the
+// Progress in opts, unless it is nil.
+func Compress(ctx context.Context, fs afero.Fs, file afero.File, k int, opts PlotOptions) (afero.File, int, error) {
+	h, err := ParsePlotHeader(file)
+	if err != nil {
+		return file, 0, err
+	}
+	if h.LastTable != 7 {
+		return file, 0, fmt.Errorf("cannot compress plot with %d tables", h.LastTable)
+	}
+	pointers := h.Tables
+	numEntries := countEntries(k, pointers, h.LastTableEnd)
+
+	compressedPath := compressedPlotPath(file.Name(), opts.TempDir2)
+	compressed, lastIndex, tableStart, err := openPhasePlot(fs, file, k, compressedPath, compressionPhase, opts.Retry, opts.Progress)
+	if err != nil {
+		return file, 0, err
+	}
+	if err := updateFlags(compressed, CompressedFlag); err != nil {
+		compressed.Close()
+		return file, 0, fmt.Errorf("cannot update encoding flags: %w", err)
+	}
+
+	wrote := tableStart - 1
+	if lastIndex < 7 {
+		s, err := newLinePointSorter(ctx, fs, file, k, compressedPath, opts)
+		if err != nil {
+			compressed.Close()
+			return file, wrote, err
+		}
+		defer s.close()
+
+		for t := 1; t <= 6; t++ {
+			if err := ctx.Err(); err != nil {
+				compressed.Close()
+				return file, wrote, err
+			}
+			var tr *tracker
+			if t > lastIndex {
+				tr = track(opts.Progress, compressionPhase, t, StepCompress, numEntries[t+1])
+			}
+			// Line points of previously compressed tables still need to be computed
+			// to figure out the positions of their entries in the compressed tables.
+			if err := s.sortLinePoints(t+1, pointers[t-1], numEntries[t], pointers[t], numEntries[t+1], tr); err != nil {
+				compressed.Close()
+				return file, wrote, err
+			}
+			if t <= lastIndex {
+				continue
+			}
+
+			tWrote, err := serialize.WriteParkTableFrom(compressed, int64(tableStart), k, s.linePoints)
+			if err != nil {
+				compressed.Close()
+				return file, wrote, fmt.Errorf("cannot write parks of table %d: %w", t, err)
+			}
+			if err := updateLastTableIndexAndPositions(compressed, t, tableStart, tableStart+tWrote); err != nil {
+				compressed.Close()
+				return file, wrote, err
+			}
+			wrote = tableStart + tWrote
+			tableStart += tWrote + 1
+			tr.done(numEntries[t+1], numEntries[t+1], tWrote)
+		}
+
+		if err := ctx.Err(); err != nil {
+			compressed.Close()
+			return file, wrote, err
+		}
+		tWrote, err := compressLastTable(ctx, file, compressed, k, pointers[6], numEntries[7], tableStart, s.positions(), opts.Progress)
+		if err != nil {
+			compressed.Close()
+			return file, wrote, err
+		}
+		if err := updateLastTableIndexAndPositions(compressed, 7, tableStart, tableStart+tWrote); err != nil {
+			compressed.Close()
+			return file, wrote, err
+		}
+		wrote = tableStart + tWrote
+		tableStart += tWrote + 1
+		lastIndex = 7
+	}
+
+	if lastIndex < c3Table {
+		wrote, err = Checkpoint(ctx, file, compressed, k, pointers[6], numEntries[7], lastIndex, tableStart, opts.Progress)
+		if err != nil {
+			compressed.Close()
+			return file, wrote, err
+		}
+	}
+
+	return compressed, wrote, nil
+}
+
+// compressedPlotPath returns the path of the file the plot at plotPath
+// is compressed in, in dir or next to the plot when dir is empty.
+func compressedPlotPath(plotPath, dir string) string {
+	if dir == "" {
+		dir = filepath.Dir(plotPath)
+	}
+	return filepath.Join(dir, filepath.Base(plotPath)+compressedPlotSuffix)
+}
+
+// linePointSorter computes and sorts the line points of the entries of every
+// table on disk. It keeps three temporary files: the positions every entry of
+// the table being compressed points to, the line points of the entries, and
+// the positions the entries end up at once sorted by line point. The latter
+// make up the values the line points of the next table are computed out of.
+type linePointSorter struct {
+	ctx      context.Context
+	fs       afero.Fs
+	plot     afero.File
+	k        int
+	sortOpts sort.Options
+
+	// pointers holds the positions of the entries of table t-1 that
+	// the entries of table t point to, sorted by position.
+	pointers afero.File
+	// linePointFile holds the line points of the entries of table t,
+	// sorted by line point, along with the position of every entry.
+	linePointFile afero.File
+	// positionFile holds the positions the entries of table t end up
+	// at in the compressed table, sorted by the position of the entry.
+	positionFile afero.File
+	// numEntries is the number of entries of table t.
+	numEntries int
+}
+
+// newLinePointSorter creates the temporary files line points of the tables
+// of plot get sorted in, next to the compressed plot at compressedPath.
+func newLinePointSorter(ctx context.Context, fs afero.Fs, plot afero.File, k int, compressedPath string, opts PlotOptions) (*linePointSorter, error) {
+	s := &linePointSorter{
+		ctx:  ctx,
+		fs:   fs,
+		plot: plot,
+		k:    k,
+		sortOpts: sort.Options{
+			AvailableMemory: opts.AvailableMemory,
+			Strategy:        opts.SortStrategy,
+			Buckets:         opts.Buckets,
+		},
+	}
+	for _, f := range []struct {
+		file   *afero.File
+		suffix string
+	}{
+		{&s.pointers, pointersSuffix},
+		{&s.linePointFile, linePointsSuffix},
+		{&s.positionFile, positionsSuffix},
+	} {
+		file, err := fs.Create(compressedPath + f.suffix)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("cannot create temporary file: %w", err)
+		}
+		*f.file = file
+	}
+	return s, nil
+}
+
+// close closes and removes the temporary files of the sorter.
+func (s *linePointSorter) close() {
+	for _, file := range []afero.File{s.pointers, s.linePointFile, s.positionFile} {
+		if file != nil {
+			file.Close()
+			s.fs.Remove(file.Name())
+		}
+	}
+}
+
+// sortLinePoints computes and sorts the line points of the numEntries entries
+// of table t found at start in the plot, out of the values of the prevEntries
+// entries of table t-1 found at prevStart: x values for table 1, and positions
+// in the previous compressed table, as sorted in the position file, otherwise.
+// Once done, the line points can be read with linePoints and where every entry
+// ends up in the sorted line points with positions. Entries read are reported
+// to tr.
+func (s *linePointSorter) sortLinePoints(t, prevStart, prevEntries, start, numEntries int, tr *tracker) error {
+	// Sort the positions entries point to, so the values they
+	// point to can be read in order next to them.
+	ew := serialize.NewEntryWriter(s.pointers, 0, s.k, serialize.PositionTable)
+	err := readTable(s.ctx, s.plot, start, numEntries, s.k, t, func(i uint64, e *serialize.Entry) error {
+		if i%readCheckInterval == 0 {
+			tr.update(int(i), 0, 0)
+		}
+		return ew.Write(&serialize.Entry{Pos: e.Pos, Offset: e.Offset, Index: int(i)})
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.sort(ew, s.pointers, serialize.PositionTable); err != nil {
+		return fmt.Errorf("cannot sort positions of table %d: %w", t, err)
+	}
+
+	var values *valueWindow
+	if t == 2 {
+		values = newValueWindow(newTableReader(s.plot, prevStart, prevEntries, s.k, 1), prevEntries, func(e *serialize.Entry) uint64 { return *e.X })
+	} else {
+		values = newValueWindow(newTableReader(s.positionFile, 0, prevEntries, s.k, serialize.PositionTable), prevEntries, func(e *serialize.Entry) uint64 { return uint64(e.Index) })
+	}
+	ew = serialize.NewEntryWriter(s.linePointFile, 0, s.k, serialize.LinePointTable)
+	err = readTable(s.ctx, s.pointers, 0, numEntries, s.k, serialize.PositionTable, func(_ uint64, e *serialize.Entry) error {
+		i := uint64(e.Index)
+		left, right := *e.Pos, *e.Pos+*e.Offset
+		if right >= uint64(prevEntries) {
+			return fmt.Errorf("entry %d of table %d points outside of table %d", i, t, t-1)
+		}
+		x, err := values.value(left)
+		if err != nil {
+			return err
+		}
+		y, err := values.value(right)
+		if err != nil {
+			return err
+		}
+		if x == y {
+			return fmt.Errorf("entry %d of table %d matches the same value twice", i, t)
+		}
+		lp := encoding.SquareToLinePoint(x, y)
+		return ew.Write(&serialize.Entry{LinePoint: &lp, Pos: &i})
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.sort(ew, s.linePointFile, serialize.LinePointTable); err != nil {
+		return fmt.Errorf("cannot sort line points of table %d: %w", t, err)
+	}
+
+	// Sort the positions entries end up at by the position of the
+	// entries, so they can be read in order to compress table t+1.
+	ew = serialize.NewEntryWriter(s.positionFile, 0, s.k, serialize.PositionTable)
+	var offset uint64
+	err = readTable(s.ctx, s.linePointFile, 0, numEntries, s.k, serialize.LinePointTable, func(j uint64, e *serialize.Entry) error {
+		return ew.Write(&serialize.Entry{Pos: e.Pos, Offset: &offset, Index: int(j)})
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.sort(ew, s.positionFile, serialize.PositionTable); err != nil {
+		return fmt.Errorf("cannot sort positions of table %d: %w", t, err)
+	}
+	s.numEntries = numEntries
+	return nil
+}
+
+// sort writes EOT after the entries of table t written with ew in file,
+// and sorts them on disk.
+func (s *linePointSorter) sort(ew *serialize.EntryWriter, file afero.File, t int) error {
+	if err := ew.WriteEOT(); err != nil {
+		return err
+	}
+	if err := ew.Flush(); err != nil {
+		return err
+	}
+	return sort.OnDisk(file, s.fs, 0, int(ew.Offset()), s.k, t, s.sortOpts)
+}
+
+// linePoints provides the sorted line points of the last table sorted.
+func (s *linePointSorter) linePoints(fn func(encoding.LinePoint) error) error {
+	return readTable(s.ctx, s.linePointFile, 0, s.numEntries, s.k, serialize.LinePointTable, func(_ uint64, e *serialize.Entry) error {
+		return fn(*e.LinePoint)
+	})
+}
+
+// positions returns a reader for the positions the entries of the
+// last table sorted end up at, in the order of the entries.
+func (s *linePointSorter) positions() *tableReader {
+	return newTableReader(s.positionFile, 0, s.numEntries, s.k, serialize.PositionTable)
+}
+
+// valueWindow reads the values of the entries of a table in order, and
+// keeps the last 2^ParamOffsetSize of them around, which is as far as
+// entries of the next table point from the first position they point to.
+type valueWindow struct {
+	r          *tableReader
+	numEntries uint64
+	valueOf    func(*serialize.Entry) uint64
+	values     []uint64
+	read       uint64
+}
+
+// newValueWindow returns a window over the values of the numEntries entries
+// read from r, where the value of every entry is found with valueOf.
+func newValueWindow(r *tableReader, numEntries int, valueOf func(*serialize.Entry) uint64) *valueWindow {
+	return &valueWindow{
+		r:          r,
+		numEntries: uint64(numEntries),
+		valueOf:    valueOf,
+		values:     make([]uint64, 1<<parameters.ParamOffsetSize),
+	}
+}
+
+// value returns the value of the entry at pos, reading entries up to it.
+// Positions need to be asked for in the order entries are read, and can
+// go back at most 2^ParamOffsetSize-1 positions from the last one read.
+func (w *valueWindow) value(pos uint64) (uint64, error) {
+	for w.read <= pos && w.read < w.numEntries {
+		e, err := w.r.next()
+		if err != nil {
+			return 0, err
+		}
+		w.values[w.read%uint64(len(w.values))] = w.valueOf(e)
+		w.read++
+	}
+	if pos >= w.read || pos+uint64(len(w.values)) < w.read {
+		return 0, fmt.Errorf("position %d out of the window of read positions %d-%d", pos, w.read-uint64(len(w.values)), w.read)
+	}
+	return w.values[pos%uint64(len(w.values))], nil
+}
+
+// compressLastTable writes the position of the line point in table 6 of every
+// entry of table 7 in dst at dstStart, in the same order as the entries, as read
+// from positions. The total number of bytes written, including EOT, is returned.
+func compressLastTable(ctx context.Context, src, dst afero.File, k, srcStart, numEntries, dstStart int, positions *tableReader, progress Progress) (int, error) {
+	tr := track(progress, compressionPhase, 7, StepCompress, numEntries)
+	ew := serialize.NewEntryWriter(dst, int64(dstStart), k, serialize.CompressedTable)
+	err := readTable(ctx, src, srcStart, numEntries, k, 7, func(i uint64, e *serialize.Entry) error {
+		if i%readCheckInterval == 0 {
+			tr.update(int(i), int(i), int(ew.Offset())-dstStart)
+		}
+		p, err := positions.next()
+		if err != nil {
+			return err
+		}
+		if *p.Pos != i {
+			return fmt.Errorf("missing position of entry %d of table 7", i)
+		}
+		pos := uint64(p.Index)
+		return ew.Write(&serialize.Entry{Pos: &pos})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := ew.WriteEOT(); err != nil {
+		return 0, err
+	}
+	if err := ew.Flush(); err != nil {
+		return 0, err
+	}
+	tr.done(numEntries, numEntries, int(ew.Offset())-dstStart)
+	return int(ew.Offset()) - dstStart, nil
+}
@@ -3,73 +3,146 @@ package pos
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"math/big"
 
+	"github.com/kargakis/chiapos/pkg/encoding"
 	"github.com/kargakis/chiapos/pkg/parameters"
+	"github.com/kargakis/chiapos/pkg/rraes"
 	"github.com/kargakis/chiapos/pkg/serialize"
-	"github.com/kargakis/chiapos/pkg/utils"
 )
 
 // At is a high-level hash function that calls AES on its inputs.
 // c is meant to be created using the plot seed as a key.
-func At(x, y *big.Int, k, t int, c cipher.Block) uint64 {
-	param := new(big.Int).Lsh(big.NewInt(1), 128)
+func At(x, y encoding.Metadata, k, t int, c cipher.Block) uint64 {
+	// need to return the most significant k+paramEXT bits
+	return atBlock(x, y, k, t, c).Trunc(0, k+parameters.ParamEXT, kBlockSizeBits).Uint64()
+}
 
-	// setup x low and high
-	xLow := new(big.Int)
-	xHigh := new(big.Int)
-	xHigh.DivMod(x, param, xLow)
+// legacyAt is At as computed for legacy plots, where the output is the
+// most significant k+paramEXT bits of the last ciphertext once its
+// leading zero bits are dropped.
+func legacyAt(x, y encoding.Metadata, k, t int, c cipher.Block) uint64 {
+	res := atBlock(x, y, k, t, c)
+	bitLen := res.BitLen()
+	if bitLen < k+parameters.ParamEXT {
+		return 0
+	}
+	return res.Trunc(0, k+parameters.ParamEXT, bitLen).Uint64()
+}
 
+// atBlock returns the last ciphertext computed by At.
+func atBlock(x, y encoding.Metadata, k, t int, c cipher.Block) encoding.Metadata {
+	// setup x low and high
+	xLow, xHigh := encoding.Metadata{x[0], x[1]}, x.Rsh(128)
 	// setup y low and high
-	yLow := new(big.Int)
-	yHigh := new(big.Int)
-	yHigh.DivMod(y, param, yLow)
+	yLow, yHigh := encoding.Metadata{y[0], y[1]}, y.Rsh(128)
 
 	// estimate collation size
 	size := 2 * k * serialize.CollaSize(t)
 
 	// main logic
 	var cipherText [aes.BlockSize]byte
+	encrypt := func(m encoding.Metadata) encoding.Metadata {
+		block := m.Block()
+		c.Encrypt(cipherText[:], block[:])
+		return encoding.MetadataFromBlock(cipherText[:])
+	}
 	switch {
 	case 0 <= size && size <= 128:
-		c.Encrypt(cipherText[:], utils.FillToBlock(utils.ConcatBig(k, x, y).Bytes()))
+		encrypt(x.Concat(k, y))
 
 	case 129 <= size && size <= 256:
-		c.Encrypt(cipherText[:], utils.FillToBlock(x.Bytes()))
-		tmp := new(big.Int).SetBytes(cipherText[:])
-		c.Encrypt(cipherText[:], utils.FillToBlock(tmp.Xor(tmp, y).Bytes()))
+		encrypt(encrypt(x).Xor(y))
 
 	case 257 <= size && size <= 384:
-		var cipherConcat [aes.BlockSize]byte
-		c.Encrypt(cipherConcat[:], utils.FillToBlock(utils.ConcatBig(k, xLow, yLow).Bytes()))
-		ccBig := new(big.Int).SetBytes(cipherConcat[:])
+		cc := encrypt(xLow.Concat(k, yLow))
+		cy := encrypt(yHigh)
+		cx := encrypt(xHigh)
+		encrypt(cc.Xor(cy).Xor(cx))
 
-		var cipherYHigh [aes.BlockSize]byte
-		c.Encrypt(cipherYHigh[:], utils.FillToBlock(yHigh.Bytes()))
-		cyBig := new(big.Int).SetBytes(cipherYHigh[:])
+	case 385 <= size && size <= 512:
+		tmp := encrypt(encrypt(xHigh).Xor(xLow))
+		cy := encrypt(yHigh)
+		encrypt(tmp.Xor(cy).Xor(yLow))
+	}
+	return encoding.MetadataFromBlock(cipherText[:])
+}
 
-		var cipherXHigh [aes.BlockSize]byte
-		c.Encrypt(cipherXHigh[:], utils.FillToBlock(xHigh.Bytes()))
-		cxBig := new(big.Int).SetBytes(cipherXHigh[:])
+// AtBatch computes At for every pair of metadata in xs and ys and stores the
+// results in out. Pairs do not depend on each other, so every step of At is
+// done for all pairs at once, with a single call to EncryptBlocks.
+func AtBatch(xs, ys []encoding.Metadata, k, t int, c rraes.Block, out []uint64) {
+	n := len(xs)
+	size := 2 * k * serialize.CollaSize(t)
 
-		ccBig.Xor(ccBig, cyBig).Xor(ccBig, cxBig)
-		c.Encrypt(cipherText[:], utils.FillToBlock(ccBig.Bytes()))
+	// Every pair needs up to three independent blocks at once.
+	blocks := make([]byte, 3*n*aes.BlockSize)
+	put := func(i int, m encoding.Metadata) {
+		b := m.Block()
+		copy(blocks[i*aes.BlockSize:], b[:])
+	}
+	get := func(i int) encoding.Metadata {
+		return encoding.MetadataFromBlock(blocks[i*aes.BlockSize:])
+	}
+	encrypt := func(count int) {
+		c.EncryptBlocks(blocks[:count*aes.BlockSize], blocks[:count*aes.BlockSize])
+	}
+	low := func(m encoding.Metadata) encoding.Metadata {
+		return encoding.Metadata{m[0], m[1]}
+	}
 
-	case 385 <= size && size <= 512:
-		var tmp [aes.BlockSize]byte
-		c.Encrypt(tmp[:], utils.FillToBlock(xHigh.Bytes()))
-		tmpBig := new(big.Int).SetBytes(tmp[:])
-		c.Encrypt(tmp[:], utils.FillToBlock(tmpBig.Xor(tmpBig, xLow).Bytes()))
-		tmpBig = new(big.Int).SetBytes(tmp[:])
+	// Results of pair i are always moved to block i, which is
+	// never before any block of pair i that is yet to be read.
+	switch {
+	case 0 <= size && size <= 128:
+		for i := range xs {
+			put(i, xs[i].Concat(k, ys[i]))
+		}
+		encrypt(n)
 
-		var cipherYHigh [aes.BlockSize]byte
-		c.Encrypt(cipherYHigh[:], utils.FillToBlock(yHigh.Bytes()))
-		cyBig := new(big.Int).SetBytes(cipherYHigh[:])
+	case 129 <= size && size <= 256:
+		for i := range xs {
+			put(i, xs[i])
+		}
+		encrypt(n)
+		for i := range xs {
+			put(i, get(i).Xor(ys[i]))
+		}
+		encrypt(n)
+
+	case 257 <= size && size <= 384:
+		for i := range xs {
+			put(3*i, low(xs[i]).Concat(k, low(ys[i])))
+			put(3*i+1, ys[i].Rsh(128))
+			put(3*i+2, xs[i].Rsh(128))
+		}
+		encrypt(3 * n)
+		for i := range xs {
+			put(i, get(3*i).Xor(get(3*i+1)).Xor(get(3*i+2)))
+		}
+		encrypt(n)
 
-		c.Encrypt(cipherText[:], utils.FillToBlock(tmpBig.Xor(tmpBig, cyBig).Xor(tmpBig, yLow).Bytes()))
+	case 385 <= size && size <= 512:
+		for i := range xs {
+			put(2*i, xs[i].Rsh(128))
+			put(2*i+1, ys[i].Rsh(128))
+		}
+		encrypt(2 * n)
+		// The encrypted high half of y is only needed after the
+		// next step, so keep it out of the way.
+		cys := make([]encoding.Metadata, n)
+		for i := range xs {
+			cys[i] = get(2*i + 1)
+			put(i, get(2*i).Xor(low(xs[i])))
+		}
+		encrypt(n)
+		for i := range xs {
+			put(i, get(i).Xor(cys[i]).Xor(low(ys[i])))
+		}
+		encrypt(n)
 	}
 
 	// need to return the most significant k+paramEXT bits
-	res := new(big.Int).SetBytes(cipherText[:])
-	return utils.Trunc(res, 0, k+parameters.ParamEXT, res.BitLen()).Uint64()
+	for i := range xs {
+		out[i] = get(i).Trunc(0, k+parameters.ParamEXT, kBlockSizeBits).Uint64()
+	}
 }
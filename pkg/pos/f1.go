@@ -3,8 +3,8 @@ package pos
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
-	"math"
 	"math/big"
 
 	"github.com/kargakis/chiapos/pkg/parameters"
@@ -15,11 +15,16 @@ import (
 const (
 	// AES block size
 	kBlockSizeBits = aes.BlockSize * 8
+	// f1BatchSize is the number of inputs f1 is calculated
+	// for at once while writing the first table.
+	f1BatchSize = 1 << 12
 )
 
 type F1 struct {
 	k   int
 	key cipher.Block
+	// legacy is set to compute f1 as it got computed for legacy plots.
+	legacy bool
 }
 
 func NewF1(k int, key []byte) (*F1, error) {
@@ -43,6 +48,18 @@ func NewF1(k int, key []byte) (*F1, error) {
 	return f1, nil
 }
 
+// newLegacyF1 returns f1 as computed for legacy plots, where outputs
+// spanning two blocks dropped the leading zero bits of the part found
+// in the second block.
+func newLegacyF1(k int, key []byte) (*F1, error) {
+	f1, err := NewF1(k, key)
+	if err != nil {
+		return nil, err
+	}
+	f1.legacy = true
+	return f1, nil
+}
+
 func (f *F1) CalculateOne(x uint64) uint64 {
 	q, r := new(big.Int).DivMod(new(big.Int).SetUint64(x*uint64(f.k)), big.NewInt(kBlockSizeBits), new(big.Int))
 	// fmt.Printf("q=%d, r=%d, x=%d, k=%d\n", q.Uint64(), r.Uint64(), x, f.k)
@@ -60,8 +77,12 @@ func (f *F1) CalculateOne(x uint64) uint64 {
 		data := utils.FillToBlock(q.Add(q, big.NewInt(1)).Bytes())
 		f.key.Encrypt(q1Cipher[:], data)
 		part2 := new(big.Int).SetBytes(q1Cipher[:])
-		part2 = utils.Trunc(part2, 0, int(r.Uint64())+f.k-kBlockSizeBits, kBlockSizeBits)
-		res = utils.Concat(uint64(part2.BitLen()), part1.Uint64(), part2.Uint64())
+		part2Bits := int(r.Uint64()) + f.k - kBlockSizeBits
+		part2 = utils.Trunc(part2, 0, part2Bits, kBlockSizeBits)
+		if f.legacy {
+			part2Bits = part2.BitLen()
+		}
+		res = utils.Concat(uint64(part2Bits), part1.Uint64(), part2.Uint64())
 	}
 
 	f1x := utils.ConcatExtended(res.Uint64(), x)
@@ -69,82 +90,41 @@ func (f *F1) CalculateOne(x uint64) uint64 {
 	return f1x
 }
 
-// Calculate accepts a number and calculates a batch of
-// 2^(k+kExtraBits)-bit outputs.
-// TODO: Currently this impl is generating a lot of matches
-// in comparison to the naive approach (CalculateOne). Figure
-// out why.
-func (f *F1) Calculate(x uint64) [][]byte {
-	cipherBytes := bitsutil.ToBytes(f.k * kBlockSizeBits)
-	ciphertext := make([]byte, cipherBytes)
-	var index, start, end int
-
-	for cipherBytes > end {
-		start = index * aes.BlockSize % (cipherBytes + 1)
-		end = ((index + 1) * aes.BlockSize) % (cipherBytes + 1)
-		counterBytes := bitsutil.Uint64ToBytes(x, kBlockSizeBits)
-		f.key.Encrypt(ciphertext[start:end], counterBytes)
-		x++
-		index++
+// Calculate calculates f1 for the n consecutive inputs starting at x. The
+// counter blocks covering the outputs of all inputs are encrypted once, and
+// every k-bit output is sliced out of the resulting ciphertext stream in
+// order, which makes it equivalent to calling CalculateOne for every input
+// without encrypting the same block up to k times.
+func (f *F1) Calculate(x uint64, n int) []uint64 {
+	if n <= 0 {
+		return nil
 	}
-
-	var (
-		outputs     [][]byte
-		left, right []byte
-		xIndex      uint64
-		leftSize    int
-		needsTrunc  = bitsutil.ToBytes(f.k) != f.k/8
-	)
-
-	// slice the ciphertext properly to get back all the f(x)s
-	for i, c := range ciphertext {
-		if !containsTwoKs(i, f.k) {
-			left = append(left, c)
-			leftSize += 8
-		} else {
-			if needsTrunc {
-				lb, rb := getLeftAndRight(c, f.k-leftSize)
-				// TODO: This append is wrong, what is needed here for the
-				// left byte is to shift all other left bytes f.k-leftSize bits
-				// to the left, handle overflows, then add lb.
-				left = append(left, lb)
-				right = append(right, rb)
-				// the remaining bits (right) are assigned to leftSize
-				// since right will become left in the next iteration.
-				leftSize = 8 - (f.k - leftSize)
-			} else {
-				left = append(left, c)
-				leftSize = 0
-			}
-			outputs = append(outputs, left)
-			extended := bitsutil.Uint64ToBytes((x+xIndex)%parameters.ParamM, parameters.ParamEXT)
-			// TODO: Similar to the lb append above, this is also wrong.
-			outputs[xIndex] = append(outputs[xIndex], extended...)
-			xIndex++
-			// clean up buffers
-			left = right
-			right = nil
+	// Legacy outputs are not a plain slice of the ciphertext stream.
+	if f.legacy {
+		fxs := make([]uint64, n)
+		for i := range fxs {
+			fxs[i] = f.CalculateOne(x + uint64(i))
 		}
+		return fxs
 	}
-
-	return outputs
-}
-
-func containsTwoKs(index, k int) bool {
-	return index*8/k != (index+1)*8/k
-}
-
-func getLeftAndRight(c byte, remainingLeftSize int) (byte, byte) {
-	var mask int
-	if remainingLeftSize == 1 {
-		// the mask will overflow so we need to handle this case manually
-		mask = 7
-	} else {
-		mask = 8 - remainingLeftSize + 1
+	startBit := x * uint64(f.k)
+	first := startBit / kBlockSizeBits
+	last := (startBit + uint64(n*f.k) - 1) / kBlockSizeBits
+
+	ciphertext := make([]byte, (last-first+1)*aes.BlockSize)
+	counter := make([]byte, aes.BlockSize)
+	for q := first; q <= last; q++ {
+		// Counters are 128-bit big-endian numbers.
+		binary.BigEndian.PutUint64(counter[aes.BlockSize-8:], q)
+		offset := (q - first) * aes.BlockSize
+		f.key.Encrypt(ciphertext[offset:offset+aes.BlockSize], counter)
 	}
-	m := byte(math.Pow(2, float64(mask)))
 
-	left := c >> (8 - remainingLeftSize)
-	right := c % m
-	return left, right
+	r := bitsutil.NewReader(ciphertext)
+	r.Skip(int(startBit % kBlockSizeBits))
+	fxs := make([]uint64, n)
+	for i := range fxs {
+		fxs[i] = utils.ConcatExtended(r.ReadUint64(f.k), x+uint64(i))
+	}
+	return fxs
 }
@@ -1,39 +1,78 @@
 package pos
 
-import "testing"
+import (
+	"math/rand"
+	"testing"
+)
 
-func TestGetLeftAndRight(t *testing.T) {
-	tests := []struct {
-		name      string
-		c         byte
-		remaining int
+func TestF1Calculate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key := make([]byte, 32)
+	r.Read(key)
+
+	for _, k := range []int{16, 17, 18, 21, 25, 32, 33, 47, 59} {
+		f1, err := NewF1(k, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cover inputs whose outputs straddle two blocks, as
+		// well as batches starting in the middle of a block.
+		starts := []uint64{0, 1, uint64(r.Int63n(1 << 16)), 1<<uint(k) - 300}
+		for _, x := range starts {
+			fxs := f1.Calculate(x, 300)
+			if len(fxs) != 300 {
+				t.Fatalf("k=%d, x=%d: expected 300 outputs, got %d", k, x, len(fxs))
+			}
+			for i, fx := range fxs {
+				if expected := f1.CalculateOne(x + uint64(i)); fx != expected {
+					t.Fatalf("k=%d, x=%d: expected f1=%d, got %d", k, x+uint64(i), expected, fx)
+				}
+			}
+		}
+	}
+}
 
-		expLeft  byte
-		expRight byte
+func TestLegacyF1(t *testing.T) {
+	key := []byte("0000000000000000legacy plot seed")
+	// Outputs of inputs spanning two blocks, as computed for legacy
+	// plots. Some of them drop leading zero bits of the second part.
+	tests := []struct {
+		k        int
+		x        uint64
+		expected uint64
+		changed  bool
 	}{
-		{
-			name:      "normal",
-			c:         0b01010101,
-			remaining: 5,
-			expLeft:   0b01010,
-			expRight:  0b101,
-		},
-		{
-			name:      "edge",
-			c:         0b11010101,
-			remaining: 1,
-			expLeft:   0b1,
-			expRight:  0b1010101,
-		},
+		{k: 17, x: 7, expected: 3356775},
+		{k: 17, x: 15, expected: 1905327},
+		{k: 17, x: 22, expected: 1607222, changed: true},
+		{k: 17, x: 30, expected: 3903326},
+		{k: 18, x: 7, expected: 3701831},
+		{k: 18, x: 14, expected: 2573486},
+		{k: 18, x: 21, expected: 1099605, changed: true},
+		{k: 18, x: 28, expected: 5627004},
+		{k: 25, x: 5, expected: 236916869},
+		{k: 25, x: 10, expected: 350786858},
+		{k: 25, x: 15, expected: 286028847, changed: true},
+		{k: 25, x: 20, expected: 648995796},
 	}
+	for _, tt := range tests {
+		legacy, err := newLegacyF1(tt.k, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := legacy.CalculateOne(tt.x); got != tt.expected {
+			t.Errorf("k=%d, x=%d: expected legacy f1=%d, got %d", tt.k, tt.x, tt.expected, got)
+		}
+		if got := legacy.Calculate(tt.x, 1); got[0] != tt.expected {
+			t.Errorf("k=%d, x=%d: expected legacy f1=%d from batch, got %d", tt.k, tt.x, tt.expected, got[0])
+		}
 
-	for _, test := range tests {
-		left, right := getLeftAndRight(test.c, test.remaining)
-		if left != test.expLeft {
-			t.Fatalf("%s: expected left byte: %08b, got: %08b", test.name, test.expLeft, left)
+		f1, err := NewF1(tt.k, key)
+		if err != nil {
+			t.Fatal(err)
 		}
-		if right != test.expRight {
-			t.Fatalf("%s: expected right byte: %08b, got: %08b", test.name, test.expRight, right)
+		if got := f1.CalculateOne(tt.x); (got != tt.expected) != tt.changed {
+			t.Errorf("k=%d, x=%d: expected f1 to change: %t, got %d", tt.k, tt.x, tt.changed, got)
 		}
 	}
 }
@@ -1,19 +1,16 @@
 package pos
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math"
-	"math/big"
-	"time"
 
 	"github.com/spf13/afero"
 
+	"github.com/kargakis/chiapos/pkg/encoding"
 	"github.com/kargakis/chiapos/pkg/parameters"
 	"github.com/kargakis/chiapos/pkg/serialize"
-	"github.com/kargakis/chiapos/pkg/utils"
-	"github.com/kargakis/chiapos/pkg/utils/bits"
 	"github.com/kargakis/chiapos/pkg/utils/sort"
 )
 
@@ -22,37 +19,53 @@ import (
 // several times larger than what the final file will be, but that has all of the
 // proofs of space in it. First, F1 is computed, which is special since it uses
 // AES256, and each encryption provides multiple output values. Then, the rest of the
-// f functions are computed, and a sort on disk happens for each table.
-func ForwardPropagate(fs afero.Fs, file afero.File, k, availableMemory int, id []byte, retry bool) (int, error) {
+// f functions are computed, and a sort on disk happens for each table. If ctx is
+// cancelled, plotting stops and ctx.Err() is returned; the header keeps pointing
+// at the last table that got sorted so a retry resumes from the next one. Every
+// step is reported to the Progress in opts, unless it is nil.
+func ForwardPropagate(ctx context.Context, fs afero.Fs, file afero.File, k int, id []byte, opts PlotOptions) (int, error) {
+	sortOpts := sort.Options{
+		AvailableMemory: opts.AvailableMemory,
+		Strategy:        opts.SortStrategy,
+		Buckets:         opts.Buckets,
+		TempDir:         opts.TempDir,
+	}
+
 	// Figure out where the previous plotter got interrupted
 	var tableIndex, tableStart, tableEnd, headerLen, wrote int
 	var err error
 
-	if retry {
-		tableIndex, tableStart, tableEnd, err = getLastTableIndexAndPositions(file)
+	if opts.Retry {
+		var h *PlotHeader
+		h, err = ParsePlotHeader(file)
+		if err == nil && h.Format != serialize.BinaryFormat {
+			err = fmt.Errorf("cannot resume plot with entries in %s format", h.Format)
+		}
+		if err == nil {
+			headerLen = h.Size
+			tableIndex, tableStart, tableEnd = h.LastTable, h.LastTableStart, h.LastTableEnd
+		}
 	} else {
-		fmt.Printf("Generating plot at %s with k=%d\n", file.Name(), k)
-		headerLen, err = WriteHeader(file, k, id)
+		headerLen, err = WriteHeader(file, k, id, opts.Memo)
 	}
 	if err != nil {
 		return headerLen, err
 	}
 
-	start := time.Now()
 	if tableIndex == 0 {
-		fmt.Println("Computing table 1...")
-		wrote, err = WriteFirstTable(file, k, headerLen+1, id)
+		wrote, err = WriteFirstTable(ctx, file, k, headerLen+1, id, opts.Threads, opts.Progress)
 		if err != nil {
 			return wrote, err
 		}
-		fmt.Println("Sorting table 1...")
-		if err := sort.OnDisk(file, fs, headerLen+1, wrote+headerLen+1, availableMemory, k, 1); err != nil {
+		if err := ctx.Err(); err != nil {
+			return wrote, err
+		}
+		if err := sortTable(file, fs, headerLen+1, wrote, k, 1, sortOpts, opts.Progress); err != nil {
 			return wrote, err
 		}
 		if err := updateLastTableIndexAndPositions(file, 1, headerLen+1, wrote+headerLen+1); err != nil {
 			return wrote, err
 		}
-		fmt.Printf("F1 calculations finished in %v (wrote %s)\n", time.Since(start), utils.PrettySize(float64(wrote)))
 	}
 
 	fx, err := NewFx(k, id)
@@ -68,79 +81,271 @@ func ForwardPropagate(fs afero.Fs, file afero.File, k, availableMemory int, id [
 		// work just fine
 		tableIndex = 1
 	} else {
-		fmt.Printf("Restarting plotting process from table %d.\n", tableIndex+1)
+		resume(opts.Progress, forwardPhase, tableIndex+1)
 		previousStart = tableStart
 		currentStart = tableEnd + 1
 	}
 
 	for t := tableIndex + 1; t <= 7; t++ {
-		start = time.Now()
-		fmt.Printf("Computing table %d...\n", t)
-		tWrote, err := WriteTable(file, k, t, previousStart, currentStart, fx)
+		if err := ctx.Err(); err != nil {
+			return wrote, err
+		}
+		tWrote, err := WriteTable(ctx, file, k, t, previousStart, currentStart, fx, opts.Threads, opts.Progress)
 		if err != nil {
 			return tWrote + wrote, err
 		}
 		wrote += tWrote
 		previousStart = currentStart
 		currentStart += tWrote + 1
+		if err := ctx.Err(); err != nil {
+			return wrote, err
+		}
 
-		fmt.Printf("Sorting table %d...\n", t)
 		// Remove EOT from entries and currentStart
-		if err := sort.OnDisk(file, fs, previousStart, tWrote, availableMemory, k, t); err != nil {
+		if err := sortTable(file, fs, previousStart, tWrote, k, t, sortOpts, opts.Progress); err != nil {
 			return wrote, err
 		}
 		if err := updateLastTableIndexAndPositions(file, t, previousStart, previousStart+tWrote); err != nil {
 			return wrote, err
 		}
-		fmt.Printf("F%d calculations finished in %v (wrote %s)\n", t, time.Since(start), utils.PrettySize(float64(tWrote)))
 	}
 
 	return wrote, nil
 }
 
-func WriteFirstTable(file afero.File, k, start int, id []byte) (int, error) {
+// sortTable sorts the tableSize bytes of table t that starts at begin on disk,
+// and reports the sort to progress.
+func sortTable(file afero.File, fs afero.Fs, begin, tableSize, k, t int, opts sort.Options, progress Progress) error {
+	entries := tableSize/serialize.EntrySize(k, t) - 1
+	tr := track(progress, forwardPhase, t, StepSort, entries)
+	if err := sort.OnDisk(file, fs, begin, tableSize, k, t, opts); err != nil {
+		return err
+	}
+	tr.done(entries, entries, tableSize)
+	return nil
+}
+
+// WriteFirstTable computes f1 for every x in [0, 2^k) and writes the first table
+// in file at start. The range of x is split into chunks of f1BatchSize inputs that
+// get computed and serialized concurrently by the provided number of threads, and
+// are written out in order by a single writer. The total number of bytes written
+// is returned. If ctx is cancelled, the chunks written so far are flushed and
+// ctx.Err() is returned. Every chunk written is reported to progress, unless it
+// is nil.
+func WriteFirstTable(ctx context.Context, file afero.File, k, start int, id []byte, threads int, progress Progress) (int, error) {
 	f1, err := NewF1(k, id)
 	if err != nil {
 		return 0, err
 	}
+	if threads < 1 {
+		threads = 1
+	}
 
-	var wrote int
-	maxNumber := uint64(math.Pow(2, float64(k)))
+	type chunk struct {
+		entries []byte
+		err     error
+	}
+	type job struct {
+		x      uint64
+		size   int
+		result chan<- chunk
+	}
 
-	// TODO: Batch writes
-	for x := uint64(0); x < maxNumber; x++ {
-		f1x := f1.CalculateOne(x)
-		n, err := serialize.Write(file, int64(start+wrote), f1x, &x, nil, nil, nil, k)
-		if err != nil {
-			return wrote + n, err
+	// Results are queued in the order their jobs got dispatched, which
+	// bounds the number of chunks kept in memory and lets the writer
+	// consume them in order.
+	results := make(chan chan chunk, 2*threads)
+	jobs := make(chan job)
+	done := make(chan struct{})
+	defer close(done)
+
+	maxNumber := uint64(1) << uint(k)
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		for x := uint64(0); x < maxNumber; x += f1BatchSize {
+			size := uint64(f1BatchSize)
+			if maxNumber-x < size {
+				size = maxNumber - x
+			}
+			result := make(chan chunk, 1)
+			select {
+			case results <- result:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- job{x: x, size: int(size), result: result}:
+			case <-done:
+				return
+			}
 		}
-		wrote += n
+	}()
+
+	entrySize := serialize.EntrySize(k, 1)
+	for i := 0; i < threads; i++ {
+		go func() {
+			for j := range jobs {
+				entries := make([]byte, 0, j.size*entrySize)
+				var err error
+				for n, f1x := range f1.Calculate(j.x, j.size) {
+					x := j.x + uint64(n)
+					var b []byte
+					b, err = serialize.Encode(&serialize.Entry{Fx: f1x, X: &x}, k, 1)
+					if err != nil {
+						break
+					}
+					entries = append(entries, b...)
+				}
+				j.result <- chunk{entries: entries, err: err}
+			}
+		}()
 	}
 
-	eotBytes, err := WriteEOT(file, wrote/int(maxNumber))
-	return wrote + eotBytes, err
+	tr := track(progress, forwardPhase, 1, StepCompute, int(maxNumber))
+	var entries int
+	ew := serialize.NewEntryWriter(file, int64(start), k, 1)
+	for result := range results {
+		c := <-result
+		if c.err != nil {
+			return int(ew.Offset()) - start, c.err
+		}
+		if err := ew.WriteBytes(c.entries); err != nil {
+			return int(ew.Offset()) - start, err
+		}
+		entries += len(c.entries) / entrySize
+		tr.update(entries, entries, int(ew.Offset())-start)
+	}
+	if err := ctx.Err(); err != nil {
+		if ferr := ew.Flush(); ferr != nil {
+			return int(ew.Offset()) - start, ferr
+		}
+		return int(ew.Offset()) - start, err
+	}
+	if err := ew.WriteEOT(); err != nil {
+		return int(ew.Offset()) - start, err
+	}
+	if err := ew.Flush(); err != nil {
+		return int(ew.Offset()) - start, err
+	}
+	tr.done(entries, entries, int(ew.Offset())-start)
+	return int(ew.Offset()) - start, nil
 }
 
-// WriteEOT writes the last entry in the table that should signal
-// that we just finished reading the table.
-func WriteEOT(file afero.File, entryLen int) (int, error) {
-	eotEntry := []byte(serialize.EOT)
-	delimiter := []byte{serialize.EntriesDelimiter}
-	// prepend the same amount of bytes an entry has to the
-	// delimiter. TODO: Stop doing this?
-	rest := make([]byte, entryLen-len(eotEntry)-len(delimiter))
-	return file.Write(append(eotEntry, append(rest, delimiter...)...))
+// WriteTable reads the t-1'th table from the file and writes the t'th table.
+// Pairs of adjacent buckets are matched, and the outputs of their matches are
+// computed and serialized concurrently by the provided number of threads, then
+// written out in the order the buckets were read, so the table does not depend
+// on the number of threads. The total number of bytes and the amount of entries
+// written is returned. Both the total number of bytes and the amount of entries
+// contain EOT as an entry so callers can easily estimate the average entry size.
+// If ctx is cancelled, the bucket pairs written so far are flushed and ctx.Err()
+// is returned. Every bucket pair written is reported to progress, unless it is
+// nil, along with how many entries of the previous table it consumed.
+func WriteTable(ctx context.Context, file afero.File, k, t, previousStart, currentStart int, fx *Fx, threads int, progress Progress) (int, error) {
+	if threads < 1 {
+		threads = 1
+	}
+
+	type chunk struct {
+		entries []byte
+		count   int
+		read    int
+		err     error
+	}
+	type job struct {
+		left, right []*serialize.Entry
+		result      chan<- chunk
+	}
+
+	// Results are queued in the order their jobs got dispatched, which
+	// bounds the number of bucket pairs kept in memory and lets the
+	// writer consume them in order.
+	results := make(chan chan chunk, 2*threads)
+	jobs := make(chan job)
+	done := make(chan struct{})
+	defer close(done)
+
+	var readErr error
+	go func() {
+		defer close(results)
+		defer close(jobs)
+		readErr = readBucketPairs(file, k, t, previousStart, func(left, right []*serialize.Entry) bool {
+			result := make(chan chunk, 1)
+			select {
+			case results <- result:
+			case <-done:
+				return false
+			case <-ctx.Done():
+				return false
+			}
+			select {
+			case jobs <- job{left: left, right: right, result: result}:
+			case <-done:
+				return false
+			}
+			return true
+		})
+	}()
+
+	for i := 0; i < threads; i++ {
+		go func() {
+			matcher := new(Matcher)
+			for j := range jobs {
+				entries, count, err := matchBuckets(matcher, fx, k, t, j.left, j.right)
+				j.result <- chunk{entries: entries, count: count, read: len(j.left), err: err}
+			}
+		}()
+	}
+
+	// The previous table is followed by EOT.
+	previousEntries := (currentStart-previousStart)/serialize.EntrySize(k, t-1) - 1
+	tr := track(progress, forwardPhase, t, StepCompute, previousEntries)
+	var entries, read int
+	ew := serialize.NewEntryWriter(file, int64(currentStart), k, t)
+	for result := range results {
+		c := <-result
+		if c.err != nil {
+			return int(ew.Offset()) - currentStart, c.err
+		}
+		if err := ew.WriteBytes(c.entries); err != nil {
+			return int(ew.Offset()) - currentStart, err
+		}
+		entries += c.count
+		read += c.read
+		tr.update(read, entries, int(ew.Offset())-currentStart)
+	}
+	// The reader is done once results are closed.
+	if readErr != nil {
+		return int(ew.Offset()) - currentStart, readErr
+	}
+	if err := ctx.Err(); err != nil {
+		if ferr := ew.Flush(); ferr != nil {
+			return int(ew.Offset()) - currentStart, ferr
+		}
+		return int(ew.Offset()) - currentStart, err
+	}
+
+	if entries == 0 {
+		return int(ew.Offset()) - currentStart, fmt.Errorf("no matches found to write table #%d; try with a larger k", t)
+	}
+	if err := ew.WriteEOT(); err != nil {
+		return int(ew.Offset()) - currentStart, err
+	}
+	if err := ew.Flush(); err != nil {
+		return int(ew.Offset()) - currentStart, err
+	}
+	tr.done(previousEntries, entries, int(ew.Offset())-currentStart)
+	return int(ew.Offset()) - currentStart, nil
 }
 
-// WriteTable reads the t-1'th table from the file and writes the t'th table.
-// The total number of bytes and the amount of entries written is returned.
-// Both the total number of bytes and the amount of entries contain EOT as an
-// entry so callers can easily estimate the average entry size.
-func WriteTable(file afero.File, k, t, previousStart, currentStart int, fx *Fx) (int, error) {
+// readBucketPairs reads the t-1'th table from the file and calls fn with every
+// pair of adjacent buckets in order, until fn returns false.
+func readBucketPairs(file afero.File, k, t, previousStart int, fn func(left, right []*serialize.Entry) bool) error {
 	var (
-		read    int
-		wrote   int
-		entries int
+		read int
 
 		bucketID     uint64
 		leftBucketID uint64
@@ -149,18 +354,17 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart int, fx *Fx)
 	)
 
 	var index int
-	entryLen := serialize.EntrySize(k, t)
 
 	for {
 		// Read an entry from the previous table.
-		leftEntry, bytesRead, err := serialize.Read(file, int64(previousStart+read), entryLen, k)
+		leftEntry, bytesRead, err := serialize.Read(file, int64(previousStart+read), k, t-1)
 		if errors.Is(err, serialize.EOTErr) || errors.Is(err, io.EOF) {
 			break
 		}
 		if err != nil {
-			return wrote, fmt.Errorf("cannot read left entry: %w", err)
+			return fmt.Errorf("cannot read left entry: %w", err)
 		}
-		leftEntry.Index = previousStart + read
+		leftEntry.Index = index
 		read += bytesRead
 
 		leftBucketID = parameters.BucketID(leftEntry.Fx)
@@ -176,41 +380,8 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart int, fx *Fx)
 		default:
 			if len(leftBucket) > 0 && len(rightBucket) > 0 {
 				// We have finished adding to both buckets, now we need to compare them.
-				// For any matches, we are going to calculate outputs for the next table.
-				matches := FindMatches(leftBucket, rightBucket)
-				for _, m := range matches {
-					le, re := m.Left, m.Right
-					var leftMetadata, rightMetadata *big.Int
-					if le.X != nil {
-						leftMetadata = big.NewInt(int64(*le.X))
-					} else if le.Collated != nil {
-						leftMetadata = le.Collated
-					}
-					if re.X != nil {
-						rightMetadata = big.NewInt(int64(*re.X))
-					} else if re.Collated != nil {
-						rightMetadata = re.Collated
-					}
-
-					f, err := fx.Calculate(t, le.Fx, leftMetadata, rightMetadata)
-					if err != nil {
-						return wrote, err
-					}
-					// This is the collated output stored next to the entry - useful
-					// for generating outputs for the next table.
-					collated, err := Collate(t, k, leftMetadata, rightMetadata)
-					if err != nil {
-						return wrote, err
-					}
-					// Now write the new output in the next table.
-					index := uint64(le.Index)
-					offset := uint64(re.Index - le.Index)
-					w, err := serialize.Write(file, int64(currentStart+wrote), f, nil, &index, &offset, collated, k)
-					if err != nil {
-						return wrote, err
-					}
-					entries++
-					wrote += w
+				if !fn(leftBucket, rightBucket) {
+					return nil
 				}
 			}
 			if leftBucketID == bucketID+2 {
@@ -230,130 +401,60 @@ func WriteTable(file afero.File, k, t, previousStart, currentStart int, fx *Fx)
 		// advance the table index
 		index++
 	}
-
-	if entries == 0 {
-		return wrote, fmt.Errorf("no matches found to write table #%d; try with a larger k", t)
-	}
-
-	eotBytes, err := WriteEOT(file, wrote/entries)
-	return wrote + eotBytes, err
+	return nil
 }
 
-var plotHeader = []byte("Proof of Space Plot")
-
-// WriteHeader writes the plot file header to a file
-// 19 bytes  - "Proof of Space Plot" (utf-8)
-// 32 bytes  - unique plot id
-// 1 byte    - k
-// 1 byte    - index of the last table that got successfully written, used for re-entrancy
-// 8 byte    - start of the last table that got successfully written, used for re-entrancy
-// 8 byte    - end of the last table that got successfully written, used for re-entrancy
-func WriteHeader(file afero.File, k int, id []byte) (int, error) {
-	n, err := file.Write(plotHeader)
-	if err != nil {
-		return n, err
-	}
-
-	nmore, err := file.Write(id)
-	n += nmore
-	if err != nil {
-		return n, err
-	}
-
-	kBytes := bits.Uint64ToBytes(uint64(k), 1)
-	nmore, err = file.Write(kBytes)
-	n += nmore
-	if err != nil {
-		return n, err
+// matchBuckets finds the matches between the provided buckets of table t-1 and
+// calculates the outputs of table t for them. The serialized entries of table t
+// are returned along with their number.
+func matchBuckets(matcher *Matcher, fx *Fx, k, t int, leftBucket, rightBucket []*serialize.Entry) ([]byte, int, error) {
+	matches := matcher.FindMatches(leftBucket, rightBucket)
+	fxs := make([]uint64, len(matches))
+	leftMetadata := make([]encoding.Metadata, len(matches))
+	rightMetadata := make([]encoding.Metadata, len(matches))
+	for i, m := range matches {
+		fxs[i] = m.Left.Fx
+		leftMetadata[i] = entryMetadata(m.Left)
+		rightMetadata[i] = entryMetadata(m.Right)
 	}
-
-	lastTableIndex := bits.Uint64ToBytes(0, 1)
-	nmore, err = file.Write(lastTableIndex)
-	n += nmore
-	if err != nil {
-		return n, err
-	}
-
-	lastTableStart := bits.Uint64ToBytes(uint64(nmore+8), 64)
-	nmore, err = file.Write(lastTableStart)
-	n += nmore
+	outputs, err := fx.CalculateBatch(t, fxs, leftMetadata, rightMetadata)
 	if err != nil {
-		return n, err
+		return nil, 0, err
 	}
 
-	// Ensure we can write indexes even for very large
-	// files by using a 64-bit number.
-	lastTableEnd := bits.Uint64ToBytes(uint64(nmore+8), 64)
-	nmore, err = file.Write(lastTableEnd)
-	return n + nmore, err
-}
-
-// GetKey returns the key from an existing plot.
-func GetKey(plotPath string) ([]byte, error) {
-	key := make([]byte, utils.KeyLen)
-
-	fs := afero.NewOsFs()
-	file, err := fs.Open(plotPath)
-	if err != nil {
-		return nil, fmt.Errorf("cannot open plot file: %w", err)
-	}
-	read, err := file.ReadAt(key, int64(len(plotHeader)))
-	if err != nil {
-		return nil, fmt.Errorf("cannot read plot: %w", err)
-	}
-	if read != utils.KeyLen {
-		return nil, fmt.Errorf("expected to read %d bytes, read %d", utils.KeyLen, read)
-	}
-
-	return key, nil
-}
-
-// getLastTableIndexAndPositions returns the index, start, and end of the
-// last table that got successfully plotted.
-func getLastTableIndexAndPositions(file afero.File) (int, int, int, error) {
-	start := int64(len(plotHeader) + utils.KeyLen + 1)
-
-	tableIndexBytes := make([]byte, 1)
-	read, err := file.ReadAt(tableIndexBytes, start)
-	if err != nil {
-		return 0, 0, 0, err
-	}
-
-	tableStartBytes := make([]byte, 8)
-	more, err := file.ReadAt(tableStartBytes, start+int64(read))
-	if err != nil {
-		return 0, 0, 0, err
-	}
-	read += more
-
-	tableEndBytes := make([]byte, 8)
-	if _, err := file.ReadAt(tableEndBytes, start+int64(read)); err != nil {
-		return 0, 0, 0, err
+	entries := make([]byte, 0, len(matches)*serialize.EntrySize(k, t))
+	for i, m := range matches {
+		le, re := m.Left, m.Right
+		// Now serialize the new output of the next table.
+		index := uint64(le.Index)
+		offset := uint64(re.Index - le.Index)
+		entry := &serialize.Entry{Fx: outputs[i], Pos: &index, Offset: &offset}
+		if t != 7 {
+			// This is the collated output stored next to the entry - useful
+			// for generating outputs for the next table.
+			collated, err := Collate(t, k, leftMetadata[i], rightMetadata[i])
+			if err != nil {
+				return nil, 0, err
+			}
+			entry.Collated = &collated
+		}
+		b, err := serialize.Encode(entry, k, t)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, b...)
 	}
-
-	return int(bits.BytesToUint64(tableIndexBytes, 1)),
-		int(bits.BytesToUint64(tableStartBytes, 64)),
-		int(bits.BytesToUint64(tableEndBytes, 64)),
-		nil
+	return entries, len(matches), nil
 }
 
-func updateLastTableIndexAndPositions(file afero.File, index, tableStart, tableEnd int) error {
-	start := int64(len(plotHeader) + utils.KeyLen + 1)
-
-	tableIndexBytes := bits.Uint64ToBytes(uint64(index), 1)
-	wrote, err := file.WriteAt(tableIndexBytes, start)
-	if err != nil {
-		return err
+// entryMetadata returns the metadata an entry of the previous
+// table passes on to compute the outputs of the next table.
+func entryMetadata(e *serialize.Entry) encoding.Metadata {
+	if e.X != nil {
+		return encoding.NewMetadata(*e.X)
 	}
-
-	tableStartBytes := bits.Uint64ToBytes(uint64(tableStart), 64)
-	more, err := file.WriteAt(tableStartBytes, start+int64(wrote))
-	if err != nil {
-		return err
+	if e.Collated != nil {
+		return *e.Collated
 	}
-	wrote += more
-
-	tableEndBytes := bits.Uint64ToBytes(uint64(tableEnd), 64)
-	_, err = file.WriteAt(tableEndBytes, start+int64(wrote))
-	return err
+	return encoding.Metadata{}
 }
@@ -0,0 +1,113 @@
+package pos
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+	"github.com/kargakis/chiapos/pkg/utils/sort"
+)
+
+func TestWriteFirstTable(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+	f1, err := NewF1(k, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	for _, threads := range []int{1, 3, 8} {
+		file, err := afero.NewMemMapFs().Create("TestWriteFirstTable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrote, err := WriteFirstTable(context.Background(), file, k, 0, id, threads, nil)
+		if err != nil {
+			t.Fatalf("threads=%d: %v", threads, err)
+		}
+		if expectedSize := (1<<k + 1) * serialize.EntrySize(k, 1); wrote != expectedSize {
+			t.Fatalf("threads=%d: expected to write %d bytes, wrote %d", threads, expectedSize, wrote)
+		}
+		table := make([]byte, wrote)
+		if _, err := file.ReadAt(table, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+
+		if expected == nil {
+			expected = table
+			size := serialize.EntrySize(k, 1)
+			for x := 0; x < 1<<k; x++ {
+				entry, err := serialize.Decode(table[x*size:(x+1)*size], k, 1)
+				if err != nil {
+					t.Fatalf("x=%d: %v", x, err)
+				}
+				if f1x := f1.CalculateOne(uint64(x)); *entry.X != uint64(x) || entry.Fx != f1x {
+					t.Fatalf("x=%d: expected f1=%d, got entry with x=%d and f1=%d", x, f1x, *entry.X, entry.Fx)
+				}
+			}
+			continue
+		}
+		if !bytes.Equal(table, expected) {
+			t.Errorf("threads=%d: first table differs from the one written by a single thread", threads)
+		}
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+	fx, err := NewFx(k, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected [][]byte
+	for _, threads := range []int{1, 3, 8} {
+		fs := afero.NewMemMapFs()
+		file, err := fs.Create("TestWriteTable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		previousStart := 0
+		wrote, err := WriteFirstTable(context.Background(), file, k, previousStart, id, threads, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tables [][]byte
+		for table := 1; table <= 3; table++ {
+			if err := sort.OnDisk(file, fs, previousStart, wrote, k, table, sort.Options{AvailableMemory: 1 << 30}); err != nil {
+				t.Fatalf("threads=%d: cannot sort table %d: %v", threads, table, err)
+			}
+			if table == 3 {
+				break
+			}
+			currentStart := previousStart + wrote
+			wrote, err = WriteTable(context.Background(), file, k, table+1, previousStart, currentStart, fx, threads, nil)
+			if err != nil {
+				t.Fatalf("threads=%d: cannot write table %d: %v", threads, table+1, err)
+			}
+			buf := make([]byte, wrote)
+			if _, err := file.ReadAt(buf, int64(currentStart)); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			tables = append(tables, buf)
+			previousStart = currentStart
+		}
+
+		if expected == nil {
+			expected = tables
+			continue
+		}
+		for i := range tables {
+			if !bytes.Equal(tables[i], expected[i]) {
+				t.Errorf("threads=%d: table %d differs from the one written by a single thread", threads, i+2)
+			}
+		}
+	}
+}
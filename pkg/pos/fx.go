@@ -1,17 +1,18 @@
 package pos
 
 import (
-	"crypto/cipher"
 	"fmt"
-	"math/big"
 
+	"github.com/kargakis/chiapos/pkg/encoding"
 	"github.com/kargakis/chiapos/pkg/parameters"
 	"github.com/kargakis/chiapos/pkg/rraes"
 )
 
 type Fx struct {
 	k   int
-	key cipher.Block
+	key rraes.Block
+	// legacy is set to compute outputs as they got computed for legacy plots.
+	legacy bool
 }
 
 func NewFx(k int, key []byte) (*Fx, error) {
@@ -35,7 +36,43 @@ func NewFx(k int, key []byte) (*Fx, error) {
 	return fx, nil
 }
 
-func (f *Fx) Calculate(t int, fx uint64, cl, cr *big.Int) (uint64, error) {
+// newLegacyFx returns the f functions of tables 2-7 as computed for legacy
+// plots, whose outputs got truncated with legacyAt.
+func newLegacyFx(k int, key []byte) (*Fx, error) {
+	fx, err := NewFx(k, key)
+	if err != nil {
+		return nil, err
+	}
+	fx.legacy = true
+	return fx, nil
+}
+
+func (f *Fx) Calculate(t int, fx uint64, cl, cr encoding.Metadata) (uint64, error) {
+	if f.legacy {
+		return legacyAt(cl, cr, f.k, t, f.key) ^ fx, nil
+	}
 	at := At(cl, cr, f.k, t, f.key)
 	return at ^ fx, nil
 }
+
+// CalculateBatch calculates the outputs of table t for every match of entries
+// of table t-1, where fxs holds the outputs of the left entries and cl and cr
+// the metadata of the left and right entries of every match. All outputs are
+// computed with a few calls to the cipher.
+func (f *Fx) CalculateBatch(t int, fxs []uint64, cl, cr []encoding.Metadata) ([]uint64, error) {
+	if len(cl) != len(fxs) || len(cr) != len(fxs) {
+		return nil, fmt.Errorf("got %d outputs for %d left and %d right metadata", len(fxs), len(cl), len(cr))
+	}
+	out := make([]uint64, len(fxs))
+	if f.legacy {
+		for i := range out {
+			out[i] = legacyAt(cl[i], cr[i], f.k, t, f.key) ^ fxs[i]
+		}
+		return out, nil
+	}
+	AtBatch(cl, cr, f.k, t, f.key, out)
+	for i := range out {
+		out[i] ^= fxs[i]
+	}
+	return out, nil
+}
@@ -0,0 +1,190 @@
+package pos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
+	"github.com/kargakis/chiapos/pkg/serialize"
+	"github.com/kargakis/chiapos/pkg/utils"
+)
+
+// concatBig is the zero-padded concatenation of x and y in big.Int.
+func concatBig(k int, x, y *big.Int) *big.Int {
+	res := new(big.Int).Lsh(x, uint(k))
+	return res.Add(res, y)
+}
+
+// atBig is the reference implementation of At in big.Int.
+func atBig(x, y *big.Int, k, t int, c cipher.Block) uint64 {
+	res := atBlockBig(x, y, k, t, c)
+	return utils.Trunc(res, 0, k+parameters.ParamEXT, kBlockSizeBits).Uint64()
+}
+
+// legacyAtBig is the reference implementation of legacyAt in big.Int.
+func legacyAtBig(x, y *big.Int, k, t int, c cipher.Block) uint64 {
+	res := atBlockBig(x, y, k, t, c)
+	return utils.Trunc(res, 0, k+parameters.ParamEXT, res.BitLen()).Uint64()
+}
+
+// atBlockBig is the reference implementation of atBlock in big.Int.
+func atBlockBig(x, y *big.Int, k, t int, c cipher.Block) *big.Int {
+	param := new(big.Int).Lsh(big.NewInt(1), 128)
+	xLow, xHigh := new(big.Int), new(big.Int)
+	xHigh.DivMod(x, param, xLow)
+	yLow, yHigh := new(big.Int), new(big.Int)
+	yHigh.DivMod(y, param, yLow)
+
+	encrypt := func(x *big.Int) *big.Int {
+		var cipherText [aes.BlockSize]byte
+		c.Encrypt(cipherText[:], utils.FillToBlock(x.Bytes()))
+		return new(big.Int).SetBytes(cipherText[:])
+	}
+	var res *big.Int
+	switch size := 2 * k * serialize.CollaSize(t); {
+	case size <= 128:
+		res = encrypt(concatBig(k, x, y))
+	case size <= 256:
+		tmp := encrypt(x)
+		res = encrypt(tmp.Xor(tmp, y))
+	case size <= 384:
+		cc := encrypt(concatBig(k, xLow, yLow))
+		cc.Xor(cc, encrypt(yHigh)).Xor(cc, encrypt(xHigh))
+		res = encrypt(cc)
+	default:
+		tmp := encrypt(xHigh)
+		tmp = encrypt(tmp.Xor(tmp, xLow))
+		res = encrypt(tmp.Xor(tmp, encrypt(yHigh)).Xor(tmp, yLow))
+	}
+	return res
+}
+
+// collateBig is the reference implementation of Collate in big.Int.
+func collateBig(t, k int, l, r *big.Int) *big.Int {
+	switch t {
+	case 2:
+		return concatBig(k, l, r)
+	case 3:
+		return concatBig(2*k, l, r)
+	case 4:
+		return new(big.Int).Xor(l, r)
+	case 5:
+		tmp := new(big.Int).Xor(l, r)
+		return utils.Trunc(tmp, 0, tmp.BitLen()*3/4, tmp.BitLen())
+	case 6:
+		tmp := new(big.Int).Xor(l, r)
+		return utils.Trunc(tmp, 0, tmp.BitLen()*2/3, tmp.BitLen())
+	}
+	return nil
+}
+
+// randomMetadata returns metadata used to compute
+// outputs of table t, in both representations.
+func randomMetadata(r *rand.Rand, k, t int) (encoding.Metadata, *big.Int) {
+	n := new(big.Int).Lsh(big.NewInt(1), uint(serialize.CollaSize(t)*k))
+	n.Rand(r, n)
+	return encoding.MetadataFromBig(n), n
+}
+
+func TestFx(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key := make([]byte, 32)
+	r.Read(key)
+
+	// Large k covers every collation size.
+	for _, k := range []int{16, 25, 32, 33, 43, 50, 59} {
+		fx, err := NewFx(k, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for table := 2; table <= 7; table++ {
+			var fxs, outputs []uint64
+			var ls, rs []encoding.Metadata
+			for i := 0; i < 200; i++ {
+				l, lBig := randomMetadata(r, k, table)
+				rm, rBig := randomMetadata(r, k, table)
+				f := r.Uint64()
+				fxs, ls, rs = append(fxs, f), append(ls, l), append(rs, rm)
+
+				expected := atBig(lBig, rBig, k, table, fx.key) ^ f
+				got, err := fx.Calculate(table, f, l, rm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != expected {
+					t.Fatalf("k=%d, table %d: f(%x, %x): expected %d, got %d", k, table, lBig, rBig, expected, got)
+				}
+				outputs = append(outputs, got)
+
+				if table == 7 {
+					continue
+				}
+				expectedCollated := collateBig(table, k, lBig, rBig)
+				collated, err := Collate(table, k, l, rm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if collated.Big().Cmp(expectedCollated) != 0 {
+					t.Fatalf("k=%d, table %d: collate(%x, %x): expected %x, got %x", k, table, lBig, rBig, expectedCollated, collated.Big())
+				}
+			}
+
+			batch, err := fx.CalculateBatch(table, fxs, ls, rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range batch {
+				if batch[i] != outputs[i] {
+					t.Fatalf("k=%d, table %d: f(%x, %x): expected %d from batch, got %d", k, table, ls[i].Big(), rs[i].Big(), outputs[i], batch[i])
+				}
+			}
+		}
+	}
+}
+
+func TestLegacyFx(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key := make([]byte, 32)
+	r.Read(key)
+
+	for _, k := range []int{16, 25, 33, 50} {
+		fx, err := newLegacyFx(k, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for table := 2; table <= 7; table++ {
+			var fxs, outputs []uint64
+			var ls, rs []encoding.Metadata
+			for i := 0; i < 200; i++ {
+				l, lBig := randomMetadata(r, k, table)
+				rm, rBig := randomMetadata(r, k, table)
+				f := r.Uint64()
+				fxs, ls, rs = append(fxs, f), append(ls, l), append(rs, rm)
+
+				expected := legacyAtBig(lBig, rBig, k, table, fx.key) ^ f
+				got, err := fx.Calculate(table, f, l, rm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != expected {
+					t.Fatalf("k=%d, table %d: legacy f(%x, %x): expected %d, got %d", k, table, lBig, rBig, expected, got)
+				}
+				outputs = append(outputs, got)
+			}
+
+			batch, err := fx.CalculateBatch(table, fxs, ls, rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range batch {
+				if batch[i] != outputs[i] {
+					t.Fatalf("k=%d, table %d: legacy f(%x, %x): expected %d from batch, got %d", k, table, ls[i].Big(), rs[i].Big(), outputs[i], batch[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+	"github.com/kargakis/chiapos/pkg/utils"
+	"github.com/kargakis/chiapos/pkg/utils/bits"
+	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
+)
+
+const (
+	// plotMagic is found at the start of every plot.
+	plotMagic = "Proof of Space Plot"
+	// formatDescription describes the version of the plot format
+	// written by WriteHeader.
+	formatDescription = "v1.0"
+)
+
+const (
+	// descriptionOffset is the offset of the size of the format
+	// description in the header, which is followed by the format
+	// description itself.
+	descriptionOffset = len(plotMagic)
+	// idOffset is the offset of the plot id in the header.
+	idOffset = descriptionOffset + 2 + len(formatDescription)
+	// kOffset is the offset of k in the header.
+	kOffset = idOffset + utils.KeyLen
+	// formatOffset is the offset of the entry format in the header.
+	formatOffset = kOffset + 1
+	// flagsOffset is the offset of the encoding flags in the header.
+	flagsOffset = formatOffset + 1
+	// phaseOffset is the offset of the plotting phase in the header.
+	phaseOffset = flagsOffset + 1
+	// lastTableOffset is the offset of the index of the last table
+	// that got successfully written in the header, which is followed
+	// by the start and the end of the table.
+	lastTableOffset = phaseOffset + 1
+	// tablePointersOffset is the offset of the table pointers in the header.
+	tablePointersOffset = lastTableOffset + 1 + 8 + 8
+	// tablePointerSize is the size in bytes of a single table pointer.
+	tablePointerSize = 8
+	// memoOffset is the offset of the size of the memo in the header,
+	// which is followed by the memo itself.
+	memoOffset = tablePointersOffset + c3Table*tablePointerSize
+)
+
+// Plots created before the header got versioned start with the plot id
+// right after the magic, followed by k and the last table that got
+// successfully written, and all their tables are in the text format.
+const (
+	legacyIDOffset        = len(plotMagic)
+	legacyKOffset         = legacyIDOffset + utils.KeyLen
+	legacyLastTableOffset = legacyKOffset + 1
+	legacyHeaderSize      = legacyLastTableOffset + 1 + 8 + 8
+)
+
+// Plotting phases recorded in the header, used for re-entrancy. The last
+// table index and positions in the header refer to tables written during
+// the recorded phase.
+const (
+	// forwardPhase is the phase where all tables are computed.
+	forwardPhase = 1
+	// backpropagationPhase is the phase where entries that do not
+	// contribute to any proof are dropped from the tables.
+	backpropagationPhase = 2
+	// compressionPhase is the phase where tables get compressed.
+	compressionPhase = 3
+)
+
+// Encoding flags recorded in the header.
+const (
+	// CompressedFlag is set when tables 1-6 are stored in parks of line
+	// points, and the outputs of table 7 are stored in the checkpoint
+	// tables.
+	CompressedFlag uint8 = 1 << iota
+)
+
+// PlotHeader is the header found at the start of every plot. It describes
+// how the plot is encoded and keeps track of the plotting progress, so an
+// interrupted plotting process can be resumed.
+type PlotHeader struct {
+	// Version is the description of the format of the plot.
+	// Legacy plots have no version.
+	Version string
+	// ID is the unique id of the plot.
+	ID []byte
+	// K is the space parameter of the plot.
+	K int
+	// Format is the format of the entries of tables that are
+	// not stored in parks.
+	Format serialize.Format
+	// Flags holds the encoding flags of the plot.
+	Flags uint8
+	// Phase is the plotting phase the last table that got
+	// successfully written belongs to.
+	Phase int
+	// LastTable is the index of the last table that got successfully
+	// written, and LastTableStart and LastTableEnd are where it starts
+	// and ends in the plot.
+	LastTable      int
+	LastTableStart int
+	LastTableEnd   int
+	// Tables holds the start of tables 1-7 and the checkpoint tables,
+	// where the start of table t is found at index t-1. Legacy plots
+	// do not track it.
+	Tables []int
+	// Memo is the memo the plot id got derived with.
+	Memo []byte
+	// Size is the size of the header in bytes.
+	Size int
+}
+
+// Legacy reports whether the header was written before the
+// header got versioned.
+func (h *PlotHeader) Legacy() bool {
+	return h.Version == ""
+}
+
+// Compressed reports whether the tables of the plot are compressed.
+func (h *PlotHeader) Compressed() bool {
+	return h.Flags&CompressedFlag != 0
+}
+
+// Complete reports whether all the tables of the plot are written. Legacy
+// plots do not record their plotting phase, so they are assumed complete.
+func (h *PlotHeader) Complete() bool {
+	return h.Legacy() || h.Phase == compressionPhase && h.LastTable == c3Table
+}
+
+// ReadPlotHeader reads the header of the plot found at plotPath
+// in the filesystem of type fsType.
+func ReadPlotHeader(plotPath, fsType string) (*PlotHeader, error) {
+	fs, err := fsutil.GetFs(fsType)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fs.Open(plotPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open plot file: %w", err)
+	}
+	defer file.Close()
+	return ParsePlotHeader(file)
+}
+
+// ParsePlotHeader parses the header found at the start of the provided
+// plot. Legacy headers are only supported for plots in the text format.
+func ParsePlotHeader(r io.ReaderAt) (*PlotHeader, error) {
+	prefix := make([]byte, descriptionOffset+2)
+	if err := readHeaderField(r, prefix, 0, "magic"); err != nil {
+		return nil, err
+	}
+	if string(prefix[:len(plotMagic)]) != plotMagic {
+		return nil, errors.New("invalid plot header: magic not found")
+	}
+
+	// Legacy plots have the plot id where the size of the format
+	// description is, so the description cannot be trusted unless
+	// it matches a known version.
+	descriptionSize := int(bits.BytesToUint64(prefix[descriptionOffset:], 16))
+	if descriptionSize == len(formatDescription) {
+		description := make([]byte, descriptionSize)
+		if err := readHeaderField(r, description, descriptionOffset+2, "format description"); err != nil {
+			return nil, err
+		}
+		if string(description) == formatDescription {
+			return parseHeader(r)
+		}
+	}
+	return parseLegacyHeader(r)
+}
+
+// parseHeader parses a header written by WriteHeader.
+func parseHeader(r io.ReaderAt) (*PlotHeader, error) {
+	buf := make([]byte, memoOffset+2-idOffset)
+	if err := readHeaderField(r, buf, idOffset, "header"); err != nil {
+		return nil, err
+	}
+	field := func(offset, size int) []byte {
+		return buf[offset-idOffset : offset-idOffset+size]
+	}
+
+	h := &PlotHeader{
+		Version:        formatDescription,
+		ID:             append([]byte{}, field(idOffset, utils.KeyLen)...),
+		K:              int(field(kOffset, 1)[0]),
+		Format:         serialize.Format(field(formatOffset, 1)[0]),
+		Flags:          field(flagsOffset, 1)[0],
+		Phase:          int(field(phaseOffset, 1)[0]),
+		LastTable:      int(field(lastTableOffset, 1)[0]),
+		LastTableStart: int(bits.BytesToUint64(field(lastTableOffset+1, 8), 64)),
+		LastTableEnd:   int(bits.BytesToUint64(field(lastTableOffset+9, 8), 64)),
+		Tables:         make([]int, c3Table),
+	}
+	if h.Format != serialize.TextFormat && h.Format != serialize.BinaryFormat {
+		return nil, fmt.Errorf("invalid plot header: unknown entry format %d", h.Format)
+	}
+	if h.Phase < forwardPhase || h.Phase > compressionPhase {
+		return nil, fmt.Errorf("invalid plot header: unknown plotting phase %d", h.Phase)
+	}
+	for i := range h.Tables {
+		h.Tables[i] = int(bits.BytesToUint64(field(tablePointersOffset+i*tablePointerSize, tablePointerSize), 64))
+	}
+
+	h.Memo = make([]byte, bits.BytesToUint64(field(memoOffset, 2), 16))
+	if err := readHeaderField(r, h.Memo, memoOffset+2, "memo"); err != nil {
+		return nil, err
+	}
+	h.Size = memoOffset + 2 + len(h.Memo)
+	return h, nil
+}
+
+// parseLegacyHeader parses a header written before the header got
+// versioned. Legacy plots never recorded the format of their entries
+// so the byte right after the header, which is left empty before the
+// first table, reads as zero, ie. serialize.TextFormat. Plots with any
+// other value got created while the format was still changing and are
+// not supported.
+func parseLegacyHeader(r io.ReaderAt) (*PlotHeader, error) {
+	buf := make([]byte, legacyHeaderSize+1)
+	if err := readHeaderField(r, buf, 0, "legacy header"); err != nil {
+		return nil, err
+	}
+	if buf[legacyHeaderSize] != byte(serialize.TextFormat) {
+		return nil, errors.New("unsupported plot header: plot got created by an unreleased version of the plotter and needs to be plotted again")
+	}
+	return &PlotHeader{
+		ID:             append([]byte{}, buf[legacyIDOffset:legacyKOffset]...),
+		K:              int(buf[legacyKOffset]),
+		Format:         serialize.TextFormat,
+		Phase:          forwardPhase,
+		LastTable:      int(buf[legacyLastTableOffset]),
+		LastTableStart: int(bits.BytesToUint64(buf[legacyLastTableOffset+1:legacyLastTableOffset+9], 64)),
+		LastTableEnd:   int(bits.BytesToUint64(buf[legacyLastTableOffset+9:legacyLastTableOffset+17], 64)),
+		Size:           legacyHeaderSize,
+	}, nil
+}
+
+func readHeaderField(r io.ReaderAt, buf []byte, offset int, name string) error {
+	if _, err := r.ReadAt(buf, int64(offset)); err != nil {
+		return fmt.Errorf("cannot read plot header: cannot read %s: %w", name, err)
+	}
+	return nil
+}
+
+// WriteHeader writes the plot file header to a file
+// 19 bytes  - "Proof of Space Plot" (utf-8)
+// 2 bytes   - size of the format description
+// 4 bytes   - format description
+// 32 bytes  - unique plot id
+// 1 byte    - k
+// 1 byte    - format of the table entries
+// 1 byte    - encoding flags
+// 1 byte    - plotting phase the last table that got successfully written belongs to
+// 1 byte    - index of the last table that got successfully written, used for re-entrancy
+// 8 byte    - start of the last table that got successfully written, used for re-entrancy
+// 8 byte    - end of the last table that got successfully written, used for re-entrancy
+// 80 bytes  - start of each of the tables 1-7 and the checkpoint tables C1-C3
+// 2 bytes   - size of the memo
+// memo      - memo the plot id got derived with
+func WriteHeader(file afero.File, k int, id, memo []byte) (int, error) {
+	if len(id) != utils.KeyLen {
+		return 0, fmt.Errorf("plot id is %d bytes; needs to be %d", len(id), utils.KeyLen)
+	}
+	if len(memo) > MaxMemoSize {
+		return 0, fmt.Errorf("memo is %d bytes; cannot be larger than %d", len(memo), MaxMemoSize)
+	}
+
+	header := make([]byte, 0, memoOffset+2+len(memo))
+	header = append(header, plotMagic...)
+	header = append(header, bits.Uint64ToBytes(uint64(len(formatDescription)), 16)...)
+	header = append(header, formatDescription...)
+	header = append(header, id...)
+	header = append(header, byte(k))
+	header = append(header, byte(serialize.BinaryFormat))
+	// Flags are set once tables get encoded accordingly.
+	header = append(header, 0)
+	header = append(header, forwardPhase)
+	// No table is written yet, and table pointers are
+	// filled in as tables get written.
+	header = append(header, make([]byte, tablePointersOffset-lastTableOffset)...)
+	header = append(header, make([]byte, c3Table*tablePointerSize)...)
+	header = append(header, bits.Uint64ToBytes(uint64(len(memo)), 16)...)
+	header = append(header, memo...)
+
+	return file.Write(header)
+}
+
+// GetKey returns the key from an existing plot.
+func GetKey(plotPath, fsType string) ([]byte, error) {
+	h, err := ReadPlotHeader(plotPath, fsType)
+	if err != nil {
+		return nil, err
+	}
+	return h.ID, nil
+}
+
+// GetMemo returns the memo from the header of an existing plot.
+func GetMemo(plotPath, fsType string) ([]byte, error) {
+	h, err := ReadPlotHeader(plotPath, fsType)
+	if err != nil {
+		return nil, err
+	}
+	return h.Memo, nil
+}
+
+func updatePhase(file afero.File, phase int) error {
+	_, err := file.WriteAt(bits.Uint64ToBytes(uint64(phase), 1), int64(phaseOffset))
+	return err
+}
+
+func updateFlags(file afero.File, flags uint8) error {
+	_, err := file.WriteAt([]byte{flags}, int64(flagsOffset))
+	return err
+}
+
+func updateLastTableIndexAndPositions(file afero.File, index, tableStart, tableEnd int) error {
+	lastTable := make([]byte, 0, 1+8+8)
+	lastTable = append(lastTable, bits.Uint64ToBytes(uint64(index), 1)...)
+	lastTable = append(lastTable, bits.Uint64ToBytes(uint64(tableStart), 64)...)
+	// Ensure we can write indexes even for very large
+	// files by using a 64-bit number.
+	lastTable = append(lastTable, bits.Uint64ToBytes(uint64(tableEnd), 64)...)
+	if _, err := file.WriteAt(lastTable, int64(lastTableOffset)); err != nil {
+		return err
+	}
+
+	// Keep track of where every table starts so entries can be
+	// looked up by their position in the table.
+	return updateTablePointer(file, index, tableStart)
+}
+
+// updateTablePointer records the start of table t in the header.
+func updateTablePointer(file afero.File, t, tableStart int) error {
+	tablePointer := bits.Uint64ToBytes(uint64(tableStart), 64)
+	_, err := file.WriteAt(tablePointer, int64(tablePointersOffset+(t-1)*tablePointerSize))
+	return err
+}
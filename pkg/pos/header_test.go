@@ -0,0 +1,160 @@
+package pos
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+	"github.com/kargakis/chiapos/pkg/utils"
+)
+
+func TestPlotHeader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file, err := fs.Create("plot.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	id := bytes.Repeat([]byte{1}, utils.KeyLen)
+	memo := []byte("memo")
+	size, err := WriteHeader(file, 18, id, memo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, start := range []int{200, 300, 400, 500, 600, 700, 800} {
+		if err := updateLastTableIndexAndPositions(file, i+1, start, start+99); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := updatePhase(file, compressionPhase); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateFlags(file, CompressedFlag); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ParsePlotHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &PlotHeader{
+		Version:        formatDescription,
+		ID:             id,
+		K:              18,
+		Format:         serialize.BinaryFormat,
+		Flags:          CompressedFlag,
+		Phase:          compressionPhase,
+		LastTable:      7,
+		LastTableStart: 800,
+		LastTableEnd:   899,
+		Tables:         []int{200, 300, 400, 500, 600, 700, 800, 0, 0, 0},
+		Memo:           memo,
+		Size:           size,
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("expected header %+v, got %+v", expected, h)
+	}
+	if h.Legacy() || !h.Compressed() {
+		t.Errorf("expected a compressed, versioned header")
+	}
+}
+
+func TestParseLegacyPlotHeader(t *testing.T) {
+	id := bytes.Repeat([]byte{3}, utils.KeyLen)
+	legacy := append([]byte(plotMagic), id...)
+	legacy = append(legacy, 16, 7)
+	legacy = append(legacy, 0, 0, 0, 0, 0, 0, 0, 100)
+	legacy = append(legacy, 0, 0, 0, 0, 0, 0, 0, 200)
+
+	tests := []struct {
+		name      string
+		header    []byte
+		expectErr bool
+	}{
+		{name: "text format", header: append(append([]byte{}, legacy...), 0)},
+		{name: "unknown format", header: append(append([]byte{}, legacy...), 1), expectErr: true},
+		{name: "invalid magic", header: append([]byte("Proof of Work Plot!"), legacy[len(plotMagic):]...), expectErr: true},
+	}
+
+	for _, tt := range tests {
+		h, err := ParsePlotHeader(bytes.NewReader(tt.header))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !h.Legacy() || h.Compressed() {
+			t.Errorf("%s: expected an uncompressed legacy header", tt.name)
+		}
+		if !bytes.Equal(h.ID, id) || h.K != 16 || h.Format != serialize.TextFormat {
+			t.Errorf("%s: unexpected header %+v", tt.name, h)
+		}
+		if h.LastTable != 7 || h.LastTableStart != 100 || h.LastTableEnd != 200 || h.Size != legacyHeaderSize {
+			t.Errorf("%s: unexpected last table in header %+v", tt.name, h)
+		}
+	}
+}
+
+func TestOpenTextFormatPlot(t *testing.T) {
+	id := bytes.Repeat([]byte{3}, utils.KeyLen)
+	legacy := append([]byte(plotMagic), id...)
+	legacy = append(legacy, 16, 7)
+	legacy = append(legacy, 0, 0, 0, 0, 0, 0, 0, 100)
+	legacy = append(legacy, 0, 0, 0, 0, 0, 0, 0, 200)
+	legacy = append(legacy, byte(serialize.TextFormat))
+
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+	if err := os.WriteFile(plotPath, legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	plot, err := openPlotReader(plotPath, "os")
+	if err != nil {
+		t.Fatalf("cannot open plot in the text format: %v", err)
+	}
+	defer plot.file.Close()
+	if !plot.header.Legacy() || plot.format != serialize.TextFormat || plot.k != 16 {
+		t.Errorf("unexpected plot header %+v", plot.header)
+	}
+}
+
+func TestReadPlotHeader(t *testing.T) {
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+	file, err := os.Create(plotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := bytes.Repeat([]byte{1}, utils.KeyLen)
+	memo := []byte("memo")
+	if _, err := WriteHeader(file, 18, id, memo); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	key, err := GetKey(plotPath, "os")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, id) {
+		t.Errorf("expected plot id %x, got %x", id, key)
+	}
+	got, err := GetMemo(plotPath, "os")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, memo) {
+		t.Errorf("expected memo %q, got %q", memo, got)
+	}
+	if _, err := ReadPlotHeader(plotPath, "unknown"); err == nil {
+		t.Errorf("expected an unknown filesystem type to be rejected")
+	}
+}
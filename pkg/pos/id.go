@@ -0,0 +1,37 @@
+package pos
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+const (
+	// PoolPublicKeySize is the size in bytes of a pool public key.
+	PoolPublicKeySize = 48
+	// PoolContractPuzzleHashSize is the size in bytes of the puzzle
+	// hash of a pool contract.
+	PoolContractPuzzleHashSize = 32
+	// PlotPublicKeySize is the size in bytes of a plot public key.
+	PlotPublicKeySize = 48
+	// MaxMemoSize is the maximum size in bytes of the memo
+	// stored in the plot header.
+	MaxMemoSize = 1<<16 - 1
+)
+
+// PlotID derives the id of a plot from the key material of its pool and
+// the plot public key. pool is either a pool public key or the puzzle hash
+// of a pool contract, and the id is the sha256 hash of pool followed by
+// the plot public key.
+func PlotID(pool, plotPublicKey []byte) ([]byte, error) {
+	if len(pool) != PoolPublicKeySize && len(pool) != PoolContractPuzzleHashSize {
+		return nil, fmt.Errorf("pool key is %d bytes; needs to be either a %d-byte public key or a %d-byte contract puzzle hash",
+			len(pool), PoolPublicKeySize, PoolContractPuzzleHashSize)
+	}
+	if len(plotPublicKey) != PlotPublicKeySize {
+		return nil, fmt.Errorf("plot public key is %d bytes; needs to be %d", len(plotPublicKey), PlotPublicKeySize)
+	}
+	h := sha256.New()
+	h.Write(pool)
+	h.Write(plotPublicKey)
+	return h.Sum(nil), nil
+}
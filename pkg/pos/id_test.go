@@ -0,0 +1,39 @@
+package pos
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestPlotID(t *testing.T) {
+	plotPublicKey := bytes.Repeat([]byte{2}, PlotPublicKeySize)
+	tests := []struct {
+		name          string
+		pool          []byte
+		plotPublicKey []byte
+		expectErr     bool
+	}{
+		{name: "pool public key", pool: bytes.Repeat([]byte{1}, PoolPublicKeySize), plotPublicKey: plotPublicKey},
+		{name: "pool contract puzzle hash", pool: bytes.Repeat([]byte{1}, PoolContractPuzzleHashSize), plotPublicKey: plotPublicKey},
+		{name: "invalid pool key", pool: []byte{1}, plotPublicKey: plotPublicKey, expectErr: true},
+		{name: "invalid plot public key", pool: bytes.Repeat([]byte{1}, PoolPublicKeySize), plotPublicKey: []byte{2}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		id, err := PlotID(tt.pool, tt.plotPublicKey)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		expected := sha256.Sum256(append(append([]byte{}, tt.pool...), tt.plotPublicKey...))
+		if !bytes.Equal(id, expected[:]) {
+			t.Errorf("%s: expected id %x, got %x", tt.name, expected, id)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package pos
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
+)
+
+// TableInfo describes a table found in a plot.
+type TableInfo struct {
+	// Table is the index of the table. Checkpoint tables
+	// C1, C2 and C3 are tables 8, 9 and 10.
+	Table int `json:"table"`
+	// Name is the name of the table, from T1 to T7 and C1 to C3.
+	Name string `json:"name"`
+	// Start and End are where the table starts and ends in
+	// the plot, and Size is the number of bytes in between.
+	Start int `json:"start"`
+	End   int `json:"end"`
+	Size  int `json:"size"`
+	// Entries is the number of entries in the table. Tables 1-6 of
+	// compressed plots hold one line point for every entry of the
+	// next table, and C3 holds every output of table 7. Entries of
+	// tables in the text format are not counted, and it is -1.
+	Entries int `json:"entries"`
+}
+
+// PlotInfo describes a plot, as found in its header and tables.
+type PlotInfo struct {
+	// Path is the path of the plot and Size its size in bytes.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Version is the description of the format of the plot.
+	// Legacy plots have no version.
+	Version string `json:"version,omitempty"`
+	// ID is the hex-encoded plot id and K the space parameter.
+	ID string `json:"id"`
+	K  int    `json:"k"`
+	// Memo is the hex-encoded memo the plot id got derived with.
+	Memo string `json:"memo,omitempty"`
+	// Format is the format of the entries of tables that are
+	// not stored in parks.
+	Format     string `json:"format"`
+	Compressed bool   `json:"compressed"`
+	// Phase, LastTable, LastTableStart and LastTableEnd record how
+	// far plotting got, so an interrupted plotter can resume.
+	Phase          int `json:"phase"`
+	LastTable      int `json:"lastTable"`
+	LastTableStart int `json:"lastTableStart"`
+	LastTableEnd   int `json:"lastTableEnd"`
+	// Complete is set once all the tables of the plot are written.
+	Complete bool `json:"complete"`
+	// HeaderSize is the size of the header in bytes.
+	HeaderSize int `json:"headerSize"`
+	// Tables describes every table written so far. Legacy plots
+	// do not track where their tables start, so it is empty.
+	Tables []TableInfo `json:"tables,omitempty"`
+}
+
+// Inspect describes the plot found at plotPath by walking its header and
+// tables. Plots that are still being written can be inspected as well, in
+// which case only the tables written so far are described.
+func Inspect(plotPath, fsType string) (*PlotInfo, error) {
+	fs, err := fsutil.GetFs(fsType)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fs.Open(plotPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read plot: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h, err := ParsePlotHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	info := &PlotInfo{
+		Path:           plotPath,
+		Size:           stat.Size(),
+		Version:        h.Version,
+		ID:             hex.EncodeToString(h.ID),
+		K:              h.K,
+		Memo:           hex.EncodeToString(h.Memo),
+		Format:         h.Format.String(),
+		Compressed:     h.Compressed(),
+		Phase:          h.Phase,
+		LastTable:      h.LastTable,
+		LastTableStart: h.LastTableStart,
+		LastTableEnd:   h.LastTableEnd,
+		Complete:       h.Complete(),
+		HeaderSize:     h.Size,
+	}
+	if h.Legacy() {
+		return info, nil
+	}
+
+	for t := 1; t <= h.LastTable; t++ {
+		table, err := inspectTable(file, h, t, info.Size)
+		if err != nil {
+			return nil, err
+		}
+		info.Tables = append(info.Tables, *table)
+	}
+	return info, nil
+}
+
+// inspectTable describes table t of the plot with header h found in file,
+// which is size bytes long. Tables of legacy plots cannot be described.
+func inspectTable(file afero.File, h *PlotHeader, t int, size int64) (*TableInfo, error) {
+	table := &TableInfo{Table: t, Name: tableName(t), Start: h.Tables[t-1], End: h.LastTableEnd}
+	if t < h.LastTable {
+		table.End = h.Tables[t] - 1
+	}
+	if table.End < table.Start || int64(table.End) > size {
+		return nil, fmt.Errorf("table %s spans from %d to %d, out of the plot", table.Name, table.Start, table.End)
+	}
+
+	switch {
+	case h.Format != serialize.BinaryFormat:
+		table.Entries = -1
+	case parkTable(h, t):
+		pt, err := serialize.ReadParkTable(file, int64(table.Start))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read parks of table %s: %w", table.Name, err)
+		}
+		table.Entries = int(pt.NumEntries())
+		table.End = table.Start + pt.Size()
+	default:
+		entryTable := t
+		if t == c1Table || t == c2Table {
+			entryTable = serialize.CheckpointTable
+		} else if h.Compressed() && t == 7 {
+			entryTable = serialize.CompressedTable
+		}
+		// Entries have a fixed size and are followed by EOT. Tables
+		// do not always leave a byte empty before the next table, so
+		// the end of the table is found out of its entries.
+		entrySize := serialize.EntrySize(h.K, entryTable)
+		table.Entries = (table.End+1-table.Start)/entrySize - 1
+		table.End = table.Start + (table.Entries+1)*entrySize
+	}
+	table.Size = table.End - table.Start
+	return table, nil
+}
+
+// tableName returns the name of table t, where checkpoint
+// tables are named after their index among checkpoint tables.
+func tableName(t int) string {
+	if t >= c1Table {
+		return fmt.Sprintf("C%d", t-c1Table+1)
+	}
+	return fmt.Sprintf("T%d", t)
+}
+
+// parkTable reports whether table t of the plot with
+// header h is stored in parks.
+func parkTable(h *PlotHeader, t int) bool {
+	return t == c3Table || h.Compressed() && t < 7
+}
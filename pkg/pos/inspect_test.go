@@ -0,0 +1,57 @@
+package pos
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+	memo := []byte("memo")
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+
+	opts := PlotOptions{AvailableMemory: 1 << 30, Threads: 2, Memo: memo, Logger: log.New(io.Discard, "", 0)}
+	if _, err := PlotDisk(context.Background(), plotPath, k, id, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Inspect(plotPath, "os")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != hex.EncodeToString(id) || info.K != k || info.Memo != hex.EncodeToString(memo) {
+		t.Errorf("expected plot id %x, k=%d and memo %x, got %s, k=%d and memo %s", id, k, memo, info.ID, info.K, info.Memo)
+	}
+	if !info.Complete || !info.Compressed || info.Phase != compressionPhase {
+		t.Errorf("expected complete compressed plot, got phase %d (complete: %t, compressed: %t)", info.Phase, info.Complete, info.Compressed)
+	}
+	if len(info.Tables) != c3Table {
+		t.Fatalf("expected %d tables, got %d", c3Table, len(info.Tables))
+	}
+
+	previousEnd := info.HeaderSize
+	for _, table := range info.Tables {
+		if table.Start != previousEnd+1 {
+			t.Errorf("expected table %s to start at %d, got %d", table.Name, previousEnd+1, table.Start)
+		}
+		if table.Entries <= 0 || table.Size != table.End-table.Start {
+			t.Errorf("unexpected table %s: %+v", table.Name, table)
+		}
+		previousEnd = table.End
+	}
+	if previousEnd != info.LastTableEnd || int64(previousEnd) != info.Size {
+		t.Errorf("expected last table to end at %d, at the end of the plot, got %d", info.LastTableEnd, previousEnd)
+	}
+	// Table 6 holds the line points of every entry of table 7,
+	// and C3 holds their outputs.
+	t6, t7, c3 := info.Tables[5], info.Tables[6], info.Tables[c3Table-1]
+	if t6.Entries != t7.Entries || c3.Entries != t7.Entries {
+		t.Errorf("expected tables T6, T7 and C3 to hold as many entries, got %d, %d and %d", t6.Entries, t7.Entries, c3.Entries)
+	}
+}
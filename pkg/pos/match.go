@@ -29,16 +29,29 @@ type Match struct {
 	Right *serialize.Entry
 }
 
-var rightBids = [parameters.ParamC][]uint64{}
-var rightPositions = [parameters.ParamC][]int{}
+// Matcher finds matches between entries of adjacent buckets. It reuses its
+// scratch space across calls, so a single matcher cannot be used concurrently
+// but separate matchers can.
+type Matcher struct {
+	rightBids      [parameters.ParamC][]uint64
+	rightPositions [parameters.ParamC][]int
+}
+
+// FindMatches compares the two buckets read from table t-1 and returns
+// any matches. It is safe to call concurrently since every call uses
+// its own Matcher.
+func FindMatches(left, right []*serialize.Entry) []*Match {
+	return new(Matcher).FindMatches(left, right)
+}
 
 // FindMatches compares the two buckets read from table t-1 and returns
 // any matches. The matching algorithm is carried over from the reference
 // implementation since the naive approach is much slower.
-func FindMatches(left, right []*serialize.Entry) []*Match {
+func (mt *Matcher) FindMatches(left, right []*serialize.Entry) []*Match {
+	rightBids, rightPositions := &mt.rightBids, &mt.rightPositions
 	for i := 0; i < parameters.ParamC; i++ {
-		rightBids[i] = nil
-		rightPositions[i] = nil
+		rightBids[i] = rightBids[i][:0]
+		rightPositions[i] = rightPositions[i][:0]
 	}
 
 	parity := (left[0].Fx / parameters.ParamBC) % 2
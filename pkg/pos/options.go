@@ -0,0 +1,102 @@
+package pos
+
+import (
+	"github.com/spf13/afero"
+)
+
+// PlotOption configures a Plotter.
+type PlotOption func(*PlotOptions)
+
+// WithFs writes plots in fs.
+func WithFs(fs afero.Fs) PlotOption {
+	return func(o *PlotOptions) {
+		o.Fs = fs
+	}
+}
+
+// WithFsType writes plots in the filesystem of the provided type.
+func WithFsType(fsType string) PlotOption {
+	return func(o *PlotOptions) {
+		o.FsType = fsType
+	}
+}
+
+// WithTempDir writes plots in dir until they are compressed.
+func WithTempDir(dir string) PlotOption {
+	return func(o *PlotOptions) {
+		o.TempDir = dir
+	}
+}
+
+// WithTempDir2 compresses plots in dir.
+func WithTempDir2(dir string) PlotOption {
+	return func(o *PlotOptions) {
+		o.TempDir2 = dir
+	}
+}
+
+// WithFinalDir moves complete plots in dir.
+func WithFinalDir(dir string) PlotOption {
+	return func(o *PlotOptions) {
+		o.FinalDir = dir
+	}
+}
+
+// WithMemory sorts tables within the provided number of bytes.
+func WithMemory(bytes int) PlotOption {
+	return func(o *PlotOptions) {
+		o.AvailableMemory = bytes
+	}
+}
+
+// WithThreads computes tables with the provided number of goroutines.
+func WithThreads(threads int) PlotOption {
+	return func(o *PlotOptions) {
+		o.Threads = threads
+	}
+}
+
+// WithSortStrategy sorts tables that do not fit in memory
+// with the provided strategy.
+func WithSortStrategy(strategy string) PlotOption {
+	return func(o *PlotOptions) {
+		o.SortStrategy = strategy
+	}
+}
+
+// WithBuckets sorts tables in the provided number of buckets
+// when they get sorted with the bucket strategy.
+func WithBuckets(buckets int) PlotOption {
+	return func(o *PlotOptions) {
+		o.Buckets = buckets
+	}
+}
+
+// WithMemo stores memo in the header of plots.
+func WithMemo(memo []byte) PlotOption {
+	return func(o *PlotOptions) {
+		o.Memo = memo
+	}
+}
+
+// WithRetry resumes plotting from where a previous
+// plotting process got interrupted.
+func WithRetry(retry bool) PlotOption {
+	return func(o *PlotOptions) {
+		o.Retry = retry
+	}
+}
+
+// WithLogger logs messages about plotting with l.
+func WithLogger(l Logger) PlotOption {
+	return func(o *PlotOptions) {
+		o.Logger = l
+	}
+}
+
+// WithProgress notifies p while plotting progresses.
+func WithProgress(p Progress) PlotOption {
+	return func(o *PlotOptions) {
+		o.Progress = p
+	}
+}
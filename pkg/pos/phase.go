@@ -0,0 +1,174 @@
+package pos
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+)
+
+// readCheckInterval is the number of entries readTable reads
+// between checking whether it got cancelled.
+const readCheckInterval = 1 << 12
+
+// readTable calls fn in order for each of the numEntries entries of table t
+// that starts at start. Reading stops with ctx.Err() if ctx is cancelled.
+func readTable(ctx context.Context, file afero.File, start, numEntries, k, t int, fn func(uint64, *serialize.Entry) error) error {
+	tr := newTableReader(file, start, numEntries, k, t)
+	for i := 0; i < numEntries; i++ {
+		if i%readCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		entry, err := tr.next()
+		if err != nil {
+			return err
+		}
+		if err := fn(uint64(i), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableReader reads the entries of a table one after the
+// other, for tables that need to be read side by side.
+type tableReader struct {
+	r    *bufio.Reader
+	buf  []byte
+	k, t int
+	read int
+}
+
+// newTableReader returns a reader for the numEntries
+// entries of table t that starts at start.
+func newTableReader(file afero.File, start, numEntries, k, t int) *tableReader {
+	entryLen := serialize.EntrySize(k, t)
+	return &tableReader{
+		r:   bufio.NewReaderSize(io.NewSectionReader(file, int64(start), int64(numEntries*entryLen)), 1<<20),
+		buf: make([]byte, entryLen),
+		k:   k,
+		t:   t,
+	}
+}
+
+// next returns the next entry of the table.
+func (tr *tableReader) next() (*serialize.Entry, error) {
+	if _, err := io.ReadFull(tr.r, tr.buf); err != nil {
+		return nil, fmt.Errorf("cannot read entry %d of table %d: %w", tr.read, tr.t, err)
+	}
+	entry, err := serialize.Decode(tr.buf, tr.k, tr.t)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode entry %d of table %d: %w", tr.read, tr.t, err)
+	}
+	tr.read++
+	return entry, nil
+}
+
+// openPhasePlot opens the file the tables written during the provided phase
+// get written in, until they replace the plot. When retrying, previously
+// written tables are kept and resuming is reported to progress. The index
+// of the last written table and where the next table should be written
+// are returned.
+func openPhasePlot(fs afero.Fs, file afero.File, k int, path string, phase int, retry bool, progress Progress) (afero.File, int, int, error) {
+	if retry {
+		if phaseFile, err := fs.OpenFile(path, os.O_RDWR, 0); err == nil {
+			h, err := ParsePlotHeader(phaseFile)
+			if err == nil && h.LastTable > 0 {
+				resume(progress, phase, h.LastTable+1)
+				return phaseFile, h.LastTable, h.LastTableEnd + 1, nil
+			}
+			phaseFile.Close()
+		}
+	}
+
+	h, err := ParsePlotHeader(file)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	phaseFile, err := fs.Create(path)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("cannot create file for phase %d: %w", phase, err)
+	}
+	headerLen, err := WriteHeader(phaseFile, k, h.ID, h.Memo)
+	if err == nil {
+		err = updatePhase(phaseFile, phase)
+	}
+	if err != nil {
+		phaseFile.Close()
+		return nil, 0, 0, err
+	}
+	return phaseFile, 0, headerLen + 1, nil
+}
+
+// replacePlot replaces the plot with the file the tables of the current
+// phase got written in, and returns the new plot.
+func replacePlot(fs afero.Fs, file, phaseFile afero.File) (afero.File, error) {
+	plotPath := file.Name()
+	if err := file.Close(); err != nil {
+		phaseFile.Close()
+		return file, err
+	}
+	if err := phaseFile.Close(); err != nil {
+		return file, err
+	}
+	if err := fs.Rename(phaseFile.Name(), plotPath); err != nil {
+		return file, fmt.Errorf("cannot replace plot: %w", err)
+	}
+	plot, err := fs.OpenFile(plotPath, os.O_RDWR, 0)
+	if err != nil {
+		return file, err
+	}
+	return plot, nil
+}
+
+// movePlot moves the closed plot at plotPath into path. When the plot cannot
+// be renamed into path, such as when path is on another device, it is copied
+// next to path and then renamed, so path only ever holds a complete plot.
+func movePlot(fs afero.Fs, plotPath, path string) error {
+	if plotPath == path {
+		return nil
+	}
+	if err := fs.Rename(plotPath, path); err == nil {
+		return nil
+	}
+
+	copyPath := path + tempPlotSuffix
+	if err := copyPlot(fs, plotPath, copyPath); err != nil {
+		fs.Remove(copyPath)
+		return fmt.Errorf("cannot copy plot to %s: %w", path, err)
+	}
+	if err := fs.Rename(copyPath, path); err != nil {
+		fs.Remove(copyPath)
+		return fmt.Errorf("cannot move plot to %s: %w", path, err)
+	}
+	return fs.Remove(plotPath)
+}
+
+// copyPlot copies the plot at src into dst, and syncs dst to disk.
+func copyPlot(fs afero.Fs, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
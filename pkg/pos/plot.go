@@ -1,40 +1,235 @@
 package pos
 
 import (
+	"context"
+	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/afero"
 
 	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
 )
 
+// tempPlotSuffix is appended to the name of a plot to name the file
+// it is written in until it is complete.
+const tempPlotSuffix = ".tmp"
+
+// Logger logs messages about plotting. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// PlotOptions configures how a plot is written.
+type PlotOptions struct {
+	// Fs is the filesystem the plot is written in. When nil, the
+	// filesystem of type FsType is used.
+	Fs afero.Fs
+	// FsType is the type of filesystem the plot is written in.
+	// Defaults to the filesystem of the OS.
+	FsType string
+	// TempDir is the directory plots are written in until they are
+	// compressed, along with any temporary files needed to sort their
+	// tables. Defaults to the final directory.
+	TempDir string
+	// TempDir2 is the directory plots are compressed in.
+	// Defaults to TempDir.
+	TempDir2 string
+	// FinalDir is the directory complete plots are moved in.
+	// Defaults to the current directory.
+	FinalDir string
+	// SortStrategy is the strategy used to sort tables that do
+	// not fit in memory. Defaults to the merge strategy.
+	SortStrategy string
+	// Buckets is the number of buckets the bucket strategy sorts
+	// tables in. Defaults to as many as needed for every bucket
+	// to fit in the available memory.
+	Buckets int
+	// AvailableMemory is the maximum number of bytes used
+	// to sort tables.
+	AvailableMemory int
+	// Threads is the number of goroutines the tables are
+	// computed with. Defaults to one.
+	Threads int
+	// Memo is stored in the plot header along with the plot id.
+	Memo []byte
+	// Retry resumes plotting from where a previous plotting
+	// process that wrote the same plot got interrupted.
+	Retry bool
+	// Logger logs messages about plotting. Defaults to
+	// logging in the standard output.
+	Logger Logger
+	// Progress is notified while plotting progresses. Defaults
+	// to logging every step with Logger.
+	Progress Progress
+}
+
+// Plotter writes plots with the options it is configured with.
+type Plotter struct {
+	opts PlotOptions
+}
+
+// NewPlotter returns a Plotter configured with the provided options.
+func NewPlotter(options ...PlotOption) *Plotter {
+	p := &Plotter{}
+	for _, o := range options {
+		o(&p.opts)
+	}
+	return p
+}
+
 // PlotDisk is the main function that handles executing all the different
-// steps required to plot a disk.
-func PlotDisk(filename, fsType string, k, availableMemory int, id []byte, retry bool) (int, error) {
-	fs, err := fsutil.GetFs(fsType)
+// steps required to plot a disk, writing a plot with the provided id and
+// storage parameter k in filename. It is a shorthand for plotting with a
+// Plotter configured with opts.
+func PlotDisk(ctx context.Context, filename string, k int, id []byte, opts PlotOptions) (int, error) {
+	return (&Plotter{opts: opts}).Plot(ctx, filename, k, id)
+}
+
+// TempPath returns the path of the file the plot named name is written in
+// until it is complete.
+func (p *Plotter) TempPath(name string) string {
+	dir := p.opts.TempDir
+	if dir == "" {
+		dir = filepath.Dir(filepath.Join(p.opts.FinalDir, name))
+	}
+	return filepath.Join(dir, filepath.Base(name)+tempPlotSuffix)
+}
+
+// ResumePath returns the path of the file plotting the plot named name
+// resumes from with Retry. That is TempPath, unless there is no file there
+// and the plot is found in the final directory, where older plotters wrote
+// plots in place.
+func (p *Plotter) ResumePath(name string) (string, error) {
+	fs, err := p.fs()
+	if err != nil {
+		return "", err
+	}
+	tempPath := p.TempPath(name)
+	if _, err := fs.Stat(tempPath); os.IsNotExist(err) {
+		finalPath := filepath.Join(p.opts.FinalDir, name)
+		if _, err := fs.Stat(finalPath); err == nil {
+			return finalPath, nil
+		}
+	}
+	return tempPath, nil
+}
+
+// fs returns the filesystem plots are written in.
+func (p *Plotter) fs() (afero.Fs, error) {
+	if p.opts.Fs != nil {
+		return p.opts.Fs, nil
+	}
+	fsType := p.opts.FsType
+	if fsType == "" {
+		fsType = fsutil.OsType
+	}
+	return fsutil.GetFs(fsType)
+}
+
+// Plot writes a plot with the provided id and storage parameter k named
+// name. The plot is written in the temporary directories, and only moved
+// in the final directory once it is complete, so harvesters never come
+// across plots that are still being written. Plotting stops once ctx is
+// cancelled, returning ctx.Err(), and the header of the temporary plot
+// records how far plotting got so it can be resumed with Retry.
+func (p *Plotter) Plot(ctx context.Context, name string, k int, id []byte) (int, error) {
+	opts := p.opts
+	if opts.Logger == nil {
+		opts.Logger = log.New(os.Stdout, "", 0)
+	}
+	if opts.Progress == nil {
+		opts.Progress = &consoleProgress{log: opts.Logger}
+	}
+	fs, err := p.fs()
 	if err != nil {
 		return 0, err
 	}
+	finalPath := filepath.Join(opts.FinalDir, name)
+	plotPath := p.TempPath(name)
+	if opts.Retry {
+		if plotPath, err = p.ResumePath(name); err != nil {
+			return 0, err
+		}
+	}
+	if opts.TempDir2 == "" {
+		opts.TempDir2 = filepath.Dir(plotPath)
+	}
 
 	var file afero.File
-	if retry {
-		file, err = fs.OpenFile(filename, os.O_RDWR, 0)
+	if opts.Retry {
+		file, err = fs.OpenFile(plotPath, os.O_RDWR, 0)
 	} else {
-		file, err = fs.Create(filename)
+		opts.Logger.Printf("Generating plot at %s with k=%d\n", finalPath, k)
+		file, err = fs.Create(plotPath)
+		// Tables left behind by any previous plotting
+		// process are not going to be reused.
+		fs.Remove(plotPath + prunedPlotSuffix)
+		fs.Remove(compressedPlotPath(plotPath, opts.TempDir2))
 	}
 	if err != nil {
 		return 0, err
 	}
-	defer file.Close()
 
-	// Run forward propagation
-	wrote, err := ForwardPropagate(fs, file, k, availableMemory, id, retry)
+	// file is replaced after every phase that rewrites the tables,
+	// so it is closed once they are done, before any plot is moved.
+	file, compressedPath, wrote, err := runPhases(ctx, fs, file, k, id, opts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return wrote, err
 	}
+	if err := movePlot(fs, compressedPath, finalPath); err != nil {
+		return wrote, err
+	}
+	// The plot is already gone if it got compressed in place by an
+	// older plotter, or replaced by the compressed plot.
+	if plotPath == compressedPath || plotPath == finalPath {
+		return wrote, nil
+	}
+	return wrote, fs.Remove(plotPath)
+}
+
+// runPhases runs the plotting phases left to write the plot in file. The plot
+// is returned, since phases that rewrite the tables replace it, along with the
+// path of the compressed plot and the number of bytes written in it.
+func runPhases(ctx context.Context, fs afero.Fs, file afero.File, k int, id []byte, opts PlotOptions) (afero.File, string, int, error) {
+	phase := forwardPhase
+	if opts.Retry {
+		h, err := ParsePlotHeader(file)
+		if err != nil {
+			return file, "", 0, err
+		}
+		phase = h.Phase
+	}
+
+	var wrote int
+	var err error
+	if phase == forwardPhase {
+		// Run forward propagation
+		if _, err = ForwardPropagate(ctx, fs, file, k, id, opts); err != nil {
+			return file, "", 0, err
+		}
+
+		// Drop entries that cannot be part of any proof.
+		file, wrote, err = Backpropagate(ctx, fs, file, k, opts.Retry, opts.Progress)
+		if err != nil {
+			return file, "", wrote, err
+		}
+		phase = backpropagationPhase
+	}
+
+	if phase != backpropagationPhase {
+		// The plot got compressed in place by an older plotter.
+		return file, file.Name(), wrote, nil
+	}
 
-	// Checkpoint the last table so we can retrieve proofs as
-	// fast as possible.
-	cWrote, err := Checkpoint(file, k)
-	return cWrote + wrote, err
+	// Compress the tables and checkpoint the last table
+	// so we can retrieve proofs as fast as possible.
+	compressed, wrote, err := Compress(ctx, fs, file, k, opts)
+	if err != nil {
+		return file, "", wrote, err
+	}
+	return file, compressed.Name(), wrote, compressed.Close()
 }
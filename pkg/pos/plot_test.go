@@ -0,0 +1,205 @@
+package pos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kargakis/chiapos/pkg/utils/sort"
+)
+
+func TestPlotDiskCancel(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+	memo := []byte("memo")
+	dir := t.TempDir()
+
+	opts := PlotOptions{AvailableMemory: 1 << 30, Threads: 2, Memo: memo, Logger: log.New(io.Discard, "", 0)}
+
+	expectedPath := filepath.Join(dir, "expected.dat")
+	if _, err := PlotDisk(context.Background(), expectedPath, k, id, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	plotPath := filepath.Join(dir, "plot.dat")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := PlotDisk(ctx, plotPath, k, id, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected plotting to be cancelled, got %v", err)
+	}
+	if _, err := os.Stat(plotPath); !os.IsNotExist(err) {
+		t.Fatalf("expected incomplete plot to be kept out of the final directory, got %v", err)
+	}
+	opts.Retry = true
+	if _, err := PlotDisk(context.Background(), plotPath, k, id, opts); err != nil {
+		t.Fatalf("cannot resume cancelled plot: %v", err)
+	}
+
+	expected, err := os.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(plotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("resumed plot differs from a plot written without interruption")
+	}
+
+	// Older plotters wrote plots in place in the final directory.
+	inPlacePath := filepath.Join(dir, "in-place.dat")
+	opts.Retry = false
+	if _, err := PlotDisk(ctx, inPlacePath, k, id, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected plotting to be cancelled, got %v", err)
+	}
+	if err := os.Rename((&Plotter{opts: opts}).TempPath(inPlacePath), inPlacePath); err != nil {
+		t.Fatal(err)
+	}
+	opts.Retry = true
+	if _, err := PlotDisk(context.Background(), inPlacePath, k, id, opts); err != nil {
+		t.Fatalf("cannot resume cancelled plot written in place: %v", err)
+	}
+	if got, err = os.ReadFile(inPlacePath); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("resumed plot written in place differs from a plot written without interruption")
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("expected temporary files to be removed, got %d files", len(files))
+	}
+}
+
+func TestPlotDiskProgress(t *testing.T) {
+	type step struct {
+		phase, table int
+		step         Step
+	}
+	var steps []step
+	var last ProgressReport
+	progress := ProgressFunc(func(r ProgressReport) {
+		if r.Entries < last.Entries && r.Step == last.Step && r.Table == last.Table {
+			t.Errorf("entries of step %s of table %d went from %d to %d", r.Step, r.Table, last.Entries, r.Entries)
+		}
+		if r.Done {
+			steps = append(steps, step{r.Phase, r.Table, r.Step})
+			if r.Step != StepMark && r.Bytes == 0 {
+				t.Errorf("step %s of table %d is done without writing anything", r.Step, r.Table)
+			}
+		}
+		last = r
+	})
+
+	opts := PlotOptions{AvailableMemory: 1 << 30, Threads: 2, Logger: log.New(io.Discard, "", 0), Progress: progress}
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+	if _, err := PlotDisk(context.Background(), plotPath, 16, bytes.Repeat([]byte{1}, 32), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []step
+	for table := 1; table <= 7; table++ {
+		expected = append(expected, step{forwardPhase, table, StepCompute}, step{forwardPhase, table, StepSort})
+	}
+	for table := 7; table > 1; table-- {
+		expected = append(expected, step{backpropagationPhase, table, StepMark})
+	}
+	for table := 1; table <= 7; table++ {
+		expected = append(expected, step{backpropagationPhase, table, StepPrune})
+	}
+	for table := 1; table <= 7; table++ {
+		expected = append(expected, step{compressionPhase, table, StepCompress})
+	}
+	for table := c1Table; table <= c3Table; table++ {
+		expected = append(expected, step{compressionPhase, table, StepCheckpoint})
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("expected steps %v, got %v", expected, steps)
+	}
+}
+
+func TestPlotter(t *testing.T) {
+	finalDir, tempDir, tempDir2 := t.TempDir(), t.TempDir(), t.TempDir()
+	var logs bytes.Buffer
+	plotter := NewPlotter(
+		WithFinalDir(finalDir),
+		WithTempDir(tempDir),
+		WithTempDir2(tempDir2),
+		// Tables do not fit in memory so they are sorted
+		// with the help of temporary files.
+		WithMemory(1<<18),
+		WithSortStrategy(sort.BucketStrategy),
+		WithBuckets(4),
+		WithThreads(2),
+		WithLogger(log.New(&logs, "", 0)),
+	)
+	if _, err := plotter.Plot(context.Background(), "plot.dat", 16, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filepath.Join(finalDir, "plot.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	h, err := ParsePlotHeader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Phase != compressionPhase || h.LastTable != c3Table {
+		t.Errorf("expected a complete plot, got phase %d and last table %d", h.Phase, h.LastTable)
+	}
+	for _, dir := range []string{tempDir, tempDir2} {
+		if files, err := os.ReadDir(dir); err != nil || len(files) != 0 {
+			t.Errorf("expected temporary files to be removed, found %d files (%v)", len(files), err)
+		}
+	}
+	for _, line := range []string{"Generating plot at", "Sorting table 7...", "Wrote checkpoint table C3"} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("expected %q to be logged, got:\n%s", line, logs.String())
+		}
+	}
+}
+
+func TestPlotDiskLowMemory(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+
+	// Tables, line points and positions are all sorted on disk
+	// since none of them fits in 1MB.
+	for _, strategy := range []string{sort.MergeStrategy, sort.BucketStrategy} {
+		dir := t.TempDir()
+		plotPath := filepath.Join(dir, "plot.dat")
+		opts := PlotOptions{AvailableMemory: 1 << 20, SortStrategy: strategy, Threads: 2, Logger: log.New(io.Discard, "", 0)}
+		if _, err := PlotDisk(context.Background(), plotPath, k, id, opts); err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+
+		result, err := CheckPlot(plotPath, "os", 1000, []byte("seed"))
+		if err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+		if result.Proofs == 0 || len(result.Failures) > 0 {
+			t.Errorf("%s: expected proofs that verify, got %d proofs and %d failures", strategy, result.Proofs, len(result.Failures))
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Errorf("%s: expected temporary files to be removed, got %d files", strategy, len(files))
+		}
+	}
+}
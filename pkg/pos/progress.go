@@ -0,0 +1,209 @@
+package pos
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/kargakis/chiapos/pkg/utils"
+)
+
+// Step is a step plotting goes through while writing a table.
+type Step int
+
+const (
+	// StepResume is reported once when a phase resumes from a previous
+	// plotting process, with the first table that is going to be written.
+	StepResume Step = iota
+	// StepCompute computes the entries of a table out of the previous one.
+	StepCompute
+	// StepSort sorts the entries of a table on disk.
+	StepSort
+	// StepMark marks the entries of the previous table that are used
+	// by the entries of a table.
+	StepMark
+	// StepPrune drops the entries of a table that are not used.
+	StepPrune
+	// StepCompress compresses a table.
+	StepCompress
+	// StepCheckpoint writes a checkpoint table.
+	StepCheckpoint
+)
+
+var stepNames = []string{"resume", "compute", "sort", "mark", "prune", "compress", "checkpoint"}
+
+func (s Step) String() string {
+	if s < 0 || int(s) >= len(stepNames) {
+		return fmt.Sprintf("Step(%d)", int(s))
+	}
+	return stepNames[s]
+}
+
+// ProgressReport describes how far a step of plotting a table got.
+type ProgressReport struct {
+	// Phase is the phase of plotting, from 1 for forward propagation
+	// to 3 for compression.
+	Phase int
+	// Table is the table the step works on. Checkpoint tables
+	// C1, C2 and C3 are tables 8, 9 and 10.
+	Table int
+	// Step is the step the table goes through.
+	Step Step
+	// Done is set once the step is finished.
+	Done bool
+	// Entries is the number of entries processed so far, out of
+	// TotalEntries. TotalEntries is zero when it is not known.
+	Entries      int
+	TotalEntries int
+	// EntriesWritten is the number of entries written so far.
+	EntriesWritten int
+	// Bytes is the number of bytes written so far.
+	Bytes int
+	// Elapsed is the time since the step started.
+	Elapsed time.Duration
+}
+
+// ETA estimates the time left until the step is finished out of the rate
+// entries got processed so far. Zero is returned once the step is done, or
+// when no estimate can be made yet.
+func (r ProgressReport) ETA() time.Duration {
+	if r.Done || r.Entries == 0 || r.TotalEntries <= r.Entries {
+		return 0
+	}
+	return time.Duration(float64(r.Elapsed) * float64(r.TotalEntries-r.Entries) / float64(r.Entries))
+}
+
+// Progress is notified while plotting progresses, so callers can render
+// progress bars or collect metrics. Every step is reported once when it
+// starts, before any entries are processed or bytes written, then as it
+// makes progress, and once more when it is done. Reports are made by the
+// goroutine that writes the plot, in order, so Report should return quickly.
+type Progress interface {
+	Report(r ProgressReport)
+}
+
+// ProgressFunc is a function that is notified while plotting progresses.
+type ProgressFunc func(r ProgressReport)
+
+// Report calls f(r).
+func (f ProgressFunc) Report(r ProgressReport) {
+	f(r)
+}
+
+// consoleProgress logs a line when a step starts or is done.
+type consoleProgress struct {
+	log Logger
+	// Tables are computed and then sorted, and marking goes
+	// over all tables, so these are timed as a whole.
+	computeStart time.Time
+	markStart    time.Time
+}
+
+// NewConsoleProgress returns a Progress that prints a human readable line
+// in w whenever a step of plotting starts or finishes.
+func NewConsoleProgress(w io.Writer) Progress {
+	return &consoleProgress{log: log.New(w, "", 0)}
+}
+
+func (c *consoleProgress) Report(r ProgressReport) {
+	if !r.Done && (r.Entries > 0 || r.Bytes > 0) {
+		return
+	}
+	switch r.Step {
+	case StepResume:
+		if r.Phase == forwardPhase {
+			c.log.Printf("Restarting plotting process from table %d.\n", r.Table)
+		} else {
+			c.log.Printf("Restarting phase %d from table %d.\n", r.Phase, r.Table)
+		}
+	case StepCompute:
+		if !r.Done {
+			c.computeStart = time.Now()
+			c.log.Printf("Computing table %d...\n", r.Table)
+		}
+	case StepSort:
+		if !r.Done {
+			c.log.Printf("Sorting table %d...\n", r.Table)
+		} else {
+			c.log.Printf("F%d calculations finished in %v (wrote %s)\n", r.Table, time.Since(c.computeStart), utils.PrettySize(float64(r.Bytes)))
+		}
+	case StepMark:
+		if !r.Done && r.Table == 7 {
+			c.markStart = time.Now()
+			c.log.Printf("Marking entries used by the next tables...\n")
+		} else if r.Done && r.Table == 2 {
+			c.log.Printf("Marking finished in %v\n", time.Since(c.markStart))
+		}
+	case StepPrune:
+		if !r.Done {
+			c.log.Printf("Pruning table %d...\n", r.Table)
+		} else {
+			c.log.Printf("Pruned table %d in %v (kept %d out of %d entries, wrote %s)\n", r.Table, r.Elapsed, r.EntriesWritten, r.TotalEntries, utils.PrettySize(float64(r.Bytes)))
+		}
+	case StepCompress:
+		if !r.Done {
+			c.log.Printf("Compressing table %d...\n", r.Table)
+		} else {
+			c.log.Printf("Compressed table %d in %v (wrote %s)\n", r.Table, r.Elapsed, utils.PrettySize(float64(r.Bytes)))
+		}
+	case StepCheckpoint:
+		if !r.Done {
+			c.log.Printf("Writing checkpoint table C%d...\n", r.Table-7)
+		} else {
+			c.log.Printf("Wrote checkpoint table C%d in %v (wrote %s)\n", r.Table-7, r.Elapsed, utils.PrettySize(float64(r.Bytes)))
+		}
+	}
+}
+
+// tracker reports the progress of a single step. A nil tracker,
+// returned when there is no one to report to, reports nothing.
+type tracker struct {
+	progress Progress
+	report   ProgressReport
+	start    time.Time
+}
+
+// track reports that step starts for table t of the provided phase and
+// returns a tracker for it. total is the number of entries the step is
+// going to process, or zero if it is not known.
+func track(p Progress, phase, t int, step Step, total int) *tracker {
+	if p == nil {
+		return nil
+	}
+	tr := &tracker{
+		progress: p,
+		report:   ProgressReport{Phase: phase, Table: t, Step: step, TotalEntries: total},
+		start:    time.Now(),
+	}
+	p.Report(tr.report)
+	return tr
+}
+
+// update reports the number of entries processed, entries written
+// and bytes written so far. Nothing is reported until some progress
+// is made.
+func (tr *tracker) update(entries, written, bytes int) {
+	if tr == nil || entries == 0 && bytes == 0 && !tr.report.Done {
+		return
+	}
+	tr.report.Entries, tr.report.EntriesWritten, tr.report.Bytes = entries, written, bytes
+	tr.report.Elapsed = time.Since(tr.start)
+	tr.progress.Report(tr.report)
+}
+
+// done reports that the step is finished.
+func (tr *tracker) done(entries, written, bytes int) {
+	if tr == nil {
+		return
+	}
+	tr.report.Done = true
+	tr.update(entries, written, bytes)
+}
+
+// resume reports that phase is resumed from table t.
+func resume(p Progress, phase, t int) {
+	if p != nil {
+		p.Report(ProgressReport{Phase: phase, Table: t, Step: StepResume, Done: true})
+	}
+}
@@ -2,36 +2,229 @@ package pos
 
 import (
 	"bufio"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"math/big"
-	"math/bits"
 
 	"github.com/spf13/afero"
 
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
 	"github.com/kargakis/chiapos/pkg/serialize"
-	"github.com/kargakis/chiapos/pkg/utils"
 	bitsutil "github.com/kargakis/chiapos/pkg/utils/bits"
 	fsutil "github.com/kargakis/chiapos/pkg/utils/fs"
 )
 
-type SpaceProof []uint64
+// SpaceProof is a proof of space retrieved out of a plot. Proofs are packed
+// with K bits per x value when marshalled, in 8K bytes.
+type SpaceProof struct {
+	// K is the space parameter of the plot the proof comes from.
+	K int
+	// X holds the 64 x values of the proof, which are K bits long.
+	X []uint64
+}
 
+// String returns the x values of the proof separated by commas.
 func (sp SpaceProof) String() string {
 	var proofString string
-	for i, p := range sp {
+	for i, p := range sp.X {
 		proofString += fmt.Sprintf("%d", p)
-		if i != len(sp)-1 {
+		if i != len(sp.X)-1 {
 			proofString += ","
 		}
 	}
 	return proofString
 }
 
+// PackProof packs the 64 x values of proof in k bits each, most significant
+// bit first, the same way the reference implementation encodes proofs. Packed
+// proofs are 8k bytes long.
+func PackProof(proof []uint64, k int) ([]byte, error) {
+	if k < parameters.KMinPlotSize || k > parameters.KMaxPlotSize {
+		return nil, fmt.Errorf("invalid k: %d, valid range: %d - %d", k, parameters.KMinPlotSize, parameters.KMaxPlotSize)
+	}
+	if len(proof) != 64 {
+		return nil, fmt.Errorf("invalid proof length: expected 64 values, got %d", len(proof))
+	}
+	w := bitsutil.NewWriter(8 * k)
+	for _, x := range proof {
+		if x>>k != 0 {
+			return nil, fmt.Errorf("invalid proof: x value %d does not fit in %d bits", x, k)
+		}
+		w.WriteUint64(x, k)
+	}
+	return w.Bytes(), nil
+}
+
+// UnpackProof unpacks the x values of a proof packed by PackProof.
+func UnpackProof(b []byte, k int) (SpaceProof, error) {
+	if k < parameters.KMinPlotSize || k > parameters.KMaxPlotSize {
+		return SpaceProof{}, fmt.Errorf("invalid k: %d, valid range: %d - %d", k, parameters.KMinPlotSize, parameters.KMaxPlotSize)
+	}
+	if len(b) != 8*k {
+		return SpaceProof{}, fmt.Errorf("invalid packed proof: expected %d bytes for k=%d, got %d", 8*k, k, len(b))
+	}
+	r := bitsutil.NewReader(b)
+	proof := SpaceProof{K: k, X: make([]uint64, 64)}
+	for i := range proof.X {
+		proof.X[i] = r.ReadUint64(k)
+	}
+	return proof, nil
+}
+
+// MarshalBinary packs the proof with PackProof. Proofs that do not know
+// the k of their plot cannot be marshalled, and need to be packed with
+// PackProof instead.
+func (sp SpaceProof) MarshalBinary() ([]byte, error) {
+	if sp.K == 0 {
+		return nil, errors.New("cannot pack space proof: k is not set")
+	}
+	return PackProof(sp.X, sp.K)
+}
+
+// UnmarshalBinary unpacks a proof packed with PackProof, where
+// k is found out of the size of the packed proof.
+func (sp *SpaceProof) UnmarshalBinary(data []byte) error {
+	if len(data)%8 != 0 {
+		return fmt.Errorf("invalid packed proof: %d bytes is not a multiple of 8", len(data))
+	}
+	proof, err := UnpackProof(data, len(data)/8)
+	if err != nil {
+		return err
+	}
+	*sp = proof
+	return nil
+}
+
+// MarshalText returns the packed proof hex-encoded.
+func (sp SpaceProof) MarshalText() ([]byte, error) {
+	b, err := sp.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(text, b)
+	return text, nil
+}
+
+// UnmarshalText unpacks a hex-encoded packed proof.
+func (sp *SpaceProof) UnmarshalText(text []byte) error {
+	b := make([]byte, hex.DecodedLen(len(text)))
+	if _, err := hex.Decode(b, text); err != nil {
+		return fmt.Errorf("invalid packed proof: %w", err)
+	}
+	return sp.UnmarshalBinary(b)
+}
+
 // Prove returns a space proof from the provided plot using the
-// provided challenge.
+// provided challenge, which needs to be 32 bytes long. If the plot holds more than one proof for
+// the challenge, the first one is returned.
 func Prove(plotPath, fsType string, challenge []byte) (SpaceProof, error) {
+	return GetFullProof(plotPath, fsType, challenge, 0)
+}
+
+// NumProofs returns the number of space proofs the provided plot
+// holds for the provided challenge.
+func NumProofs(plotPath, fsType string, challenge []byte) (int, error) {
+	if err := validateChallenge(challenge); err != nil {
+		return 0, err
+	}
+	plot, err := openPlotReader(plotPath, fsType)
+	if err != nil {
+		return 0, err
+	}
+	defer plot.file.Close()
+
+	matches, _, err := plot.findMatches(challenge)
+	return len(matches), err
+}
+
+// GetFullProof returns the space proof found at index among all the
+// proofs the provided plot holds for the provided challenge. Indexes
+// range from 0 up to the number returned by NumProofs.
+func GetFullProof(plotPath, fsType string, challenge []byte, index int) (SpaceProof, error) {
+	if err := validateChallenge(challenge); err != nil {
+		return SpaceProof{}, err
+	}
+	plot, err := openPlotReader(plotPath, fsType)
+	if err != nil {
+		return SpaceProof{}, err
+	}
+	defer plot.file.Close()
+
+	matches, target, err := plot.findMatches(challenge)
+	if err != nil {
+		return SpaceProof{}, err
+	}
+	if len(matches) == 0 {
+		return SpaceProof{}, fmt.Errorf("no match found; no space proof exists for challenge %d", target)
+	}
+	if index < 0 || index >= len(matches) {
+		return SpaceProof{}, fmt.Errorf("proof index %d out of range: found %d proofs for challenge %d", index, len(matches), target)
+	}
+	return plot.getFullProof(matches[index])
+}
+
+// ProveAll returns all the space proofs the provided plot holds
+// for the provided challenge.
+func ProveAll(plotPath, fsType string, challenge []byte) ([]SpaceProof, error) {
+	if err := validateChallenge(challenge); err != nil {
+		return nil, err
+	}
+	plot, err := openPlotReader(plotPath, fsType)
+	if err != nil {
+		return nil, err
+	}
+	defer plot.file.Close()
+
+	matches, _, err := plot.findMatches(challenge)
+	if err != nil {
+		return nil, err
+	}
+	proofs := make([]SpaceProof, 0, len(matches))
+	for _, match := range matches {
+		proof, err := plot.getFullProof(match)
+		if err != nil {
+			return nil, err
+		}
+		proofs = append(proofs, proof)
+	}
+	return proofs, nil
+}
+
+// GetQualitiesForChallenge returns the quality strings of all the space
+// proofs the provided plot holds for the provided challenge, in the same
+// order GetFullProof retrieves the proofs. Quality strings of compressed
+// plots are computed by reading only two x values of every proof.
+func GetQualitiesForChallenge(plotPath, fsType string, challenge []byte) ([][]byte, error) {
+	if err := validateChallenge(challenge); err != nil {
+		return nil, err
+	}
+	plot, err := openPlotReader(plotPath, fsType)
+	if err != nil {
+		return nil, err
+	}
+	defer plot.file.Close()
+
+	matches, _, err := plot.findMatches(challenge)
+	if err != nil {
+		return nil, err
+	}
+	qualities := make([][]byte, 0, len(matches))
+	for _, match := range matches {
+		quality, err := plot.getQuality(challenge, match)
+		if err != nil {
+			return nil, err
+		}
+		qualities = append(qualities, quality)
+	}
+	return qualities, nil
+}
+
+// openPlotReader opens the plot found at plotPath for reading proofs.
+// Callers are responsible for closing the plot file.
+func openPlotReader(plotPath, fsType string) (*plotReader, error) {
 	fs, err := fsutil.GetFs(fsType)
 	if err != nil {
 		return nil, err
@@ -40,52 +233,142 @@ func Prove(plotPath, fsType string, challenge []byte) (SpaceProof, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot read plot: %w", err)
 	}
-	defer file.Close()
+	plot, err := newPlotReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return plot, nil
+}
+
+// findMatches returns all the entries of table 7 whose output matches
+// the provided challenge, along with the target the challenge maps to.
+func (p *plotReader) findMatches(challenge []byte) ([]*serialize.Entry, uint64, error) {
+	target := challengeTarget(challenge, p.k)
 
-	k, err := getK(file)
+	// Find all indices where f7 == target
+	var matches []*serialize.Entry
+	var err error
+	if p.compressed {
+		matches, err = p.lookupMatches(target)
+	} else {
+		matches, err = p.scanMatches(target)
+	}
+	return matches, target, err
+}
+
+// getFullProof retrieves the 64 x values of the space proof
+// that ends up in the provided entry of table 7.
+func (p *plotReader) getFullProof(match *serialize.Entry) (SpaceProof, error) {
+	proof, err := p.getProof(match)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read k: %w", err)
+		return SpaceProof{}, fmt.Errorf("cannot retrieve proof from plot: %w", err)
+	}
+	if len(proof) != 64 {
+		return SpaceProof{}, fmt.Errorf("invalid proof: expected 64 x values, got %d", len(proof))
 	}
-	// fmt.Printf("Proving space with plot %s (k=%d)\n", plotPath, k)
+	return SpaceProof{K: p.k, X: proof}, nil
+}
 
-	// get C1 start index
-	_, start, _, err := getLastTableIndexAndPositions(file)
+// plotReader reads entries out of a plot regardless of the
+// format its entries are encoded in.
+type plotReader struct {
+	file   afero.File
+	header *PlotHeader
+	k      int
+	id     []byte
+	format serialize.Format
+	// tables holds the start of every table in the plot.
+	// Plots in the text format do not track it.
+	tables []int
+	// compressed is set for plots where tables 1-6 are stored
+	// in parks of line points.
+	compressed bool
+	// parkTables caches the headers of the park tables of
+	// compressed plots, indexed by table.
+	parkTables map[int]*serialize.ParkTable
+}
+
+func newPlotReader(file afero.File) (*plotReader, error) {
+	h, err := ParsePlotHeader(file)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get last table indexes: %w", err)
+		return nil, fmt.Errorf("cannot read plot header: %w", err)
+	}
+	if !h.Complete() {
+		return nil, fmt.Errorf("incomplete plot: phase %d ended after table %d", h.Phase, h.LastTable)
+	}
+	plot := &plotReader{
+		file:       file,
+		header:     h,
+		k:          h.K,
+		id:         h.ID,
+		format:     h.Format,
+		compressed: h.Compressed(),
+	}
+	if h.Format == serialize.BinaryFormat {
+		plot.tables = h.Tables
+		plot.parkTables = make(map[int]*serialize.ParkTable)
+	}
+	return plot, nil
+}
+
+// entryTable returns the index used to serialize entries of table t.
+func (p *plotReader) entryTable(t int) int {
+	if p.compressed && t == 7 {
+		return serialize.CompressedTable
+	}
+	return t
+}
+
+// entryOffset returns the offset in the plot of the entry found at
+// pos in table t. Positions in the text format are already offsets.
+func (p *plotReader) entryOffset(t int, pos uint64) int64 {
+	if p.format == serialize.TextFormat {
+		return int64(pos)
+	}
+	return int64(p.tables[t-1]) + int64(pos)*int64(serialize.EntrySize(p.k, p.entryTable(t)))
+}
+
+// readEntry reads the entry of table t found at offset.
+func (p *plotReader) readEntry(offset int64, t int) (*serialize.Entry, int, error) {
+	if p.format == serialize.TextFormat {
+		return serialize.ReadText(p.file, offset, serialize.TextEntrySize(p.k, t), p.k)
+	}
+	return serialize.Read(p.file, offset, p.k, p.entryTable(t))
+}
+
+// scanMatches finds the entries of table 7 whose output matches target
+// by scanning table 7 from the last C1 checkpoint smaller than target.
+func (p *plotReader) scanMatches(target uint64) ([]*serialize.Entry, error) {
+	// get C1 start index
+	start := p.header.LastTableStart
+	if !p.header.Legacy() {
+		start = p.tables[c1Table-1]
 	}
 
 	// load C1 in memory
-	// fmt.Println("Loading C1 table in memory...")
-	entries, err := loadTable(file, start, k)
+	entries, err := p.loadCheckpoints(start)
 	if err != nil {
 		return nil, fmt.Errorf("cannot load table into memory: %w", err)
 	}
 
-	challBig := new(big.Int).SetBytes(challenge)
-	challBig = utils.Trunc(challBig, 0, k, challBig.BitLen())
-	target := challBig.Uint64()
-
-	index, err := getLastSmallerIndex(entries, target)
+	pos, err := getLastSmallerPosition(entries, target)
 	if err != nil {
-		return nil, fmt.Errorf("cannot get last index smaller than target %d: %w", target, err)
+		return nil, fmt.Errorf("cannot get last position smaller than target %d: %w", target, err)
 	}
 
-	// Find all indices where f7 == target
-	// fmt.Println("Searching for f7 outputs matching the challenge...",)
-	var read int
 	var matches []*serialize.Entry
-	entryLen := serialize.EntrySize(k, 7)
+	offset := p.entryOffset(7, pos)
 	for {
-		entry, bytesRead, err := serialize.Read(file, int64(index+read), entryLen, k)
+		entry, bytesRead, err := p.readEntry(offset, 7)
 		if errors.Is(err, serialize.EOTErr) {
 			break
 		}
 		if err != nil {
 			return nil, fmt.Errorf("cannot read entry: %w", err)
 		}
-		read += bytesRead
-		// Truncate fx to k bits
-		fEntry := utils.TruncPrimitive(entry.Fx, 0, k, bits.Len64(entry.Fx))
+		offset += int64(bytesRead)
+		fEntry := outputTarget(entry.Fx)
 		if fEntry == target {
 			matches = append(matches, entry)
 		}
@@ -94,45 +377,86 @@ func Prove(plotPath, fsType string, challenge []byte) (SpaceProof, error) {
 			break
 		}
 	}
+	return matches, nil
+}
 
-	if len(matches) == 0 {
-		return nil, fmt.Errorf("no match found; no space proof exists for challenge %d", target)
+// lookupMatches finds the entries of table 7 whose output matches target
+// in a compressed plot, starting from the park of C3 found by lookupPark.
+func (p *plotReader) lookupMatches(target uint64) ([]*serialize.Entry, error) {
+	c3, start, err := p.lookupPark(target)
+	if err != nil {
+		return nil, err
 	}
+	var matches []*serialize.Entry
+	for park := start; park*parameters.ParamC1 < c3.NumEntries(); park++ {
+		fxs, err := c3.Park(p.file, int(park))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read C3: %w", err)
+		}
+		for i, fx := range fxs {
+			fEntry := outputTarget(fx.Lo)
+			// We are not going to find any more matches
+			if fEntry > target {
+				return matches, nil
+			}
+			if fEntry != target {
+				continue
+			}
+			entry, _, err := p.readEntry(p.entryOffset(7, park*parameters.ParamC1+uint64(i)), 7)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read entry: %w", err)
+			}
+			entry.Fx = fx.Lo
+			matches = append(matches, entry)
+		}
+	}
+	return matches, nil
+}
 
-	// TODO: Make this index configurable
-	matchIndex := 0
-	leftPos := *matches[matchIndex].Pos
-	rightPos := *matches[matchIndex].Pos + *matches[matchIndex].Offset
+// lookupPark returns C3 along with the park where outputs of table 7 that
+// match target start. C2 is loaded in memory to find where to seek into
+// C1, and the entries of C1 between two entries of C2 point to the park.
+func (p *plotReader) lookupPark(target uint64) (*serialize.ParkTable, uint64, error) {
+	c2, err := p.loadCheckpoints(p.tables[c2Table-1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot load C2 into memory: %w", err)
+	}
+	c1Pos, err := getLastSmallerPosition(c2, target)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot get last C2 position smaller than target %d: %w", target, err)
+	}
 
-	proof, err := getInputs(file, 6, k, leftPos, rightPos)
+	c1Offset := int64(p.tables[c1Table-1]) + int64(c1Pos)*int64(serialize.EntrySize(p.k, serialize.CheckpointTable))
+	c1, err := p.readCheckpoints(c1Offset, parameters.ParamC2)
 	if err != nil {
-		return nil, fmt.Errorf("cannot retrieve proof from plot: %w", err)
+		return nil, 0, fmt.Errorf("cannot read C1: %w", err)
 	}
-	if len(proof) != 64 {
-		return nil, fmt.Errorf("invalid proof: expected 64 x values, got %d", len(proof))
+	pos, err := getLastSmallerPosition(c1, target)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot get last C1 position smaller than target %d: %w", target, err)
 	}
-	return proof, nil
-}
 
-// getK returns k from the header of the provided plot.
-func getK(file afero.File) (int, error) {
-	kBytes := make([]byte, 1)
-	if _, err := file.ReadAt(kBytes, int64(len(plotHeader)+utils.KeyLen)); err != nil {
-		return 0, err
+	c3, err := serialize.ReadParkTable(p.file, int64(p.tables[c3Table-1]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read C3: %w", err)
 	}
-	return int(bitsutil.BytesToUint64(kBytes, 1)), nil
+	return c3, pos / parameters.ParamC1, nil
 }
 
-func loadTable(file afero.File, start, k int) ([]*serialize.Entry, error) {
-	var entries []*serialize.Entry
+// loadCheckpoints loads the checkpoint table found at start in memory.
+func (p *plotReader) loadCheckpoints(start int) ([]*serialize.Entry, error) {
+	if p.format == serialize.BinaryFormat {
+		return p.readCheckpoints(int64(start), -1)
+	}
 
-	if _, err := file.Seek(int64(start), io.SeekStart); err != nil {
+	var entries []*serialize.Entry
+	if _, err := p.file.Seek(int64(start), io.SeekStart); err != nil {
 		return nil, err
 	}
-	buf := bufio.NewReader(file)
+	buf := bufio.NewReader(p.file)
 
 	for {
-		entry, err := serialize.ReadCheckpoint(buf, k)
+		entry, err := serialize.ReadTextCheckpoint(buf, p.k)
 		if errors.Is(err, serialize.EOTErr) || errors.Is(err, io.EOF) {
 			break
 		}
@@ -145,30 +469,96 @@ func loadTable(file afero.File, start, k int) ([]*serialize.Entry, error) {
 	return entries, nil
 }
 
-func getLastSmallerIndex(entries []*serialize.Entry, target uint64) (int, error) {
-	var position int
-	for _, e := range entries {
-		if e.Fx < target {
-			position = int(*e.Pos)
-		} else {
+// readCheckpoints reads up to n entries of the binary checkpoint table
+// starting at offset, or all of its entries if n is negative.
+func (p *plotReader) readCheckpoints(offset int64, n int) ([]*serialize.Entry, error) {
+	var entries []*serialize.Entry
+	for ; n != 0; n-- {
+		entry, size, err := serialize.Read(p.file, offset, p.k, serialize.CheckpointTable)
+		if errors.Is(err, serialize.EOTErr) || errors.Is(err, io.EOF) {
 			break
 		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read entry: %w", err)
+		}
+		entries = append(entries, entry)
+		offset += int64(size)
 	}
-	if position == 0 {
+	return entries, nil
+}
+
+// getLastSmallerPosition returns the position of the last checkpointed
+// entry whose output is smaller than target. If there is no such entry,
+// the position of the first checkpointed entry is returned.
+func getLastSmallerPosition(entries []*serialize.Entry, target uint64) (uint64, error) {
+	if len(entries) == 0 {
 		return 0, fmt.Errorf("no position found")
 	}
+	position := *entries[0].Pos
+	for _, e := range entries {
+		if outputTarget(e.Fx) < target {
+			position = *e.Pos
+		} else {
+			break
+		}
+	}
 	return position, nil
 }
 
+// getProof retrieves the x values of the proof of space
+// that ends up in the provided entry of table 7.
+func (p *plotReader) getProof(entry *serialize.Entry) ([]uint64, error) {
+	if !p.compressed {
+		return p.getInputs(6, *entry.Pos, *entry.Pos+*entry.Offset)
+	}
+	xs, err := p.getLinePointInputs(6, *entry.Pos)
+	if err != nil {
+		return nil, err
+	}
+	return orderProof(p.k, p.id, xs)
+}
+
+// getQuality returns the quality string of the space proof that ends up in
+// the provided entry of table 7. The last bits of the challenge select which
+// of the two line point values to follow in every table from table 6 down to
+// table 2, and the two x values found at the end of the path are hashed along
+// with the challenge. Plots that are not compressed have no line points so
+// the whole proof needs to be retrieved.
+func (p *plotReader) getQuality(challenge []byte, match *serialize.Entry) ([]byte, error) {
+	if !p.compressed {
+		proof, err := p.getFullProof(match)
+		if err != nil {
+			return nil, err
+		}
+		return GetQuality(challenge, p.k, proof.X)
+	}
+
+	pos := *match.Pos
+	for t := 6; t >= 2; t-- {
+		x, y, err := p.readLinePoint(t, pos)
+		if err != nil {
+			return nil, fmt.Errorf("cannot retrieve quality from plot: %w", err)
+		}
+		pos = y
+		if qualityBit(challenge, t) {
+			pos = x
+		}
+	}
+	x1, x2, err := p.readLinePoint(1, pos)
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve quality from plot: %w", err)
+	}
+	return qualityString(challenge, p.k, x1, x2), nil
+}
+
 // getInputs walks all tables recursively until it reaches the last table
 // to retrieve all the 64 x values comprising a proof of space.
-func getInputs(file afero.File, t, k int, leftPos, rightPos uint64) ([]uint64, error) {
-	entryLen := serialize.EntrySize(k, t)
-	leftEntry, _, err := serialize.Read(file, int64(leftPos), entryLen, k)
+func (p *plotReader) getInputs(t int, leftPos, rightPos uint64) ([]uint64, error) {
+	leftEntry, _, err := p.readEntry(p.entryOffset(t, leftPos), t)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read left entry at table %d: %w", t, err)
 	}
-	rightEntry, _, err := serialize.Read(file, int64(rightPos), entryLen, k)
+	rightEntry, _, err := p.readEntry(p.entryOffset(t, rightPos), t)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read right entry at table %d: %w", t, err)
 	}
@@ -178,13 +568,113 @@ func getInputs(file afero.File, t, k int, leftPos, rightPos uint64) ([]uint64, e
 	}
 
 	// aggregate inputs from previous table and forward to the next
-	left, err := getInputs(file, t-1, k, *leftEntry.Pos, *leftEntry.Pos+*leftEntry.Offset)
+	left, err := p.getInputs(t-1, *leftEntry.Pos, *leftEntry.Pos+*leftEntry.Offset)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get inputs for left entry at table %d: %w", t, err)
 	}
-	right, err := getInputs(file, t-1, k, *rightEntry.Pos, *rightEntry.Pos+*rightEntry.Offset)
+	right, err := p.getInputs(t-1, *rightEntry.Pos, *rightEntry.Pos+*rightEntry.Offset)
 	if err != nil {
 		return nil, fmt.Errorf("cannot get inputs for right entry at table %d: %w", t, err)
 	}
 	return append(left, right...), nil
 }
+
+// getLinePointInputs walks the line points of compressed tables recursively
+// until it reaches the first table to retrieve all the x values behind the
+// line point found at pos in table t. Line points do not retain which value
+// was the left one, so x values are not returned in proof order.
+func (p *plotReader) getLinePointInputs(t int, pos uint64) ([]uint64, error) {
+	x, y, err := p.readLinePoint(t, pos)
+	if err != nil {
+		return nil, err
+	}
+	if t == 1 {
+		return []uint64{x, y}, nil
+	}
+
+	left, err := p.getLinePointInputs(t-1, x)
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.getLinePointInputs(t-1, y)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// readLinePoint reads the line point found at pos in the park table
+// of table t, and returns the two values it is made of, larger first.
+func (p *plotReader) readLinePoint(t int, pos uint64) (uint64, uint64, error) {
+	pt, ok := p.parkTables[t]
+	if !ok {
+		var err error
+		pt, err = serialize.ReadParkTable(p.file, int64(p.tables[t-1]))
+		if err != nil {
+			return 0, 0, fmt.Errorf("cannot read table %d: %w", t, err)
+		}
+		p.parkTables[t] = pt
+	}
+
+	lp, err := pt.LinePoint(p.file, pos)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot read line point at table %d: %w", t, err)
+	}
+	x, y := encoding.LinePointToSquare(lp)
+	return x, y, nil
+}
+
+// orderProof reorders the provided x values, so every pair of values
+// that got matched, and every pair of matches in the next tables, is
+// in the order it got matched in, ie. the left value is in the bucket
+// preceding the bucket of the right value.
+func orderProof(k int, id []byte, xs []uint64) ([]uint64, error) {
+	f1, err := NewF1(k, id)
+	if err != nil {
+		return nil, err
+	}
+	fx, err := NewFx(k, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var fxs []uint64
+	var metadata []encoding.Metadata
+	for _, x := range xs {
+		fxs = append(fxs, f1.CalculateOne(x))
+		metadata = append(metadata, encoding.NewMetadata(x))
+	}
+
+	for t := 2; t <= 7; t++ {
+		// Number of x values behind every output of table t-1.
+		size := len(xs) / len(fxs)
+		var newFxs []uint64
+		var newMetadata []encoding.Metadata
+		for i := 0; i < len(fxs); i += 2 {
+			left, right := i, i+1
+			if parameters.BucketID(fxs[left]) > parameters.BucketID(fxs[right]) {
+				fxs[left], fxs[right] = fxs[right], fxs[left]
+				metadata[left], metadata[right] = metadata[right], metadata[left]
+				leftXs := append([]uint64{}, xs[left*size:right*size]...)
+				copy(xs[left*size:], xs[right*size:(right+1)*size])
+				copy(xs[right*size:], leftXs)
+			}
+
+			f, err := fx.Calculate(t, fxs[left], metadata[left], metadata[right])
+			if err != nil {
+				return nil, fmt.Errorf("cannot compute f%d(x): %w", t, err)
+			}
+			newFxs = append(newFxs, f)
+			if t != 7 {
+				collated, err := Collate(t, k, metadata[left], metadata[right])
+				if err != nil {
+					return nil, fmt.Errorf("cannot collate outputs: %w", err)
+				}
+				newMetadata = append(newMetadata, collated)
+			}
+		}
+		fxs = newFxs
+		metadata = newMetadata
+	}
+	return xs, nil
+}
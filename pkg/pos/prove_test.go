@@ -0,0 +1,380 @@
+package pos
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kargakis/chiapos/pkg/parameters"
+	"github.com/kargakis/chiapos/pkg/serialize"
+)
+
+func TestPackProof(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, k := range []int{16, 17, 25, 32, 59} {
+		proof := make([]uint64, 64)
+		for i := range proof {
+			proof[i] = r.Uint64() >> (64 - k)
+		}
+		// The first x value uses all k bits.
+		proof[0] |= 1 << (k - 1)
+
+		packed, err := PackProof(proof, k)
+		if err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		if len(packed) != 8*k {
+			t.Fatalf("k=%d: expected %d bytes, got %d", k, 8*k, len(packed))
+		}
+		got, err := UnpackProof(packed, k)
+		if err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		if got.K != k || !reflect.DeepEqual(got.X, proof) {
+			t.Errorf("k=%d: expected %v, got %v", k, proof, got)
+		}
+	}
+
+	proof := make([]uint64, 64)
+	proof[10] = 1 << 16
+	if _, err := PackProof(proof, 16); err == nil {
+		t.Errorf("expected x values larger than k bits to fail packing")
+	}
+	if _, err := PackProof(proof[:63], 17); err == nil {
+		t.Errorf("expected proofs without 64 x values to fail packing")
+	}
+	if _, err := UnpackProof(make([]byte, 8*16+1), 16); err == nil {
+		t.Errorf("expected packed proofs of the wrong size to fail unpacking")
+	}
+}
+
+func TestSpaceProofMarshal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, k := range []int{16, 21, 32} {
+		// Proofs are packed in k bits per x value, even
+		// if none of their x values use all k bits.
+		proof := SpaceProof{K: k, X: make([]uint64, 64)}
+		for i := range proof.X {
+			proof.X[i] = r.Uint64() >> (64 - k + 1)
+		}
+
+		b, err := proof.MarshalBinary()
+		if err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		if len(b) != 8*k {
+			t.Fatalf("k=%d: expected %d bytes, got %d", k, 8*k, len(b))
+		}
+		var got SpaceProof
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		if !reflect.DeepEqual(got, proof) {
+			t.Errorf("k=%d: expected %v, got %v", k, proof, got)
+		}
+
+		text, err := proof.MarshalText()
+		if err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		if string(text) != hex.EncodeToString(b) {
+			t.Errorf("k=%d: expected %x, got %s", k, b, text)
+		}
+		got = SpaceProof{}
+		if err := got.UnmarshalText(text); err != nil {
+			t.Fatalf("k=%d: %v", k, err)
+		}
+		if !reflect.DeepEqual(got, proof) {
+			t.Errorf("k=%d: expected %v, got %v", k, proof, got)
+		}
+	}
+
+	proof := SpaceProof{X: make([]uint64, 64)}
+	if _, err := proof.MarshalBinary(); err == nil {
+		t.Errorf("expected proofs without k to fail marshalling")
+	}
+	if _, err := proof.MarshalText(); err == nil {
+		t.Errorf("expected proofs without k to fail marshalling")
+	}
+	if err := proof.UnmarshalBinary(make([]byte, 8*16-1)); err == nil {
+		t.Errorf("expected packed proofs of the wrong size to fail unmarshalling")
+	}
+	if err := proof.UnmarshalText([]byte("zz")); err == nil {
+		t.Errorf("expected packed proofs that are not hex-encoded to fail unmarshalling")
+	}
+}
+
+// writeCheckpointedPlot writes a compressed plot whose table 7 holds the
+// provided sorted outputs, along with their checkpoint tables, and opens
+// it for reading proofs. Tables 1-6 are left out, so proofs cannot be
+// retrieved, but matches can be looked up.
+func writeCheckpointedPlot(t *testing.T, k int, fxs []uint64) *plotReader {
+	t.Helper()
+	dir := t.TempDir()
+	src, err := os.Create(filepath.Join(dir, "table7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	ew := serialize.NewEntryWriter(src, 0, k, 7)
+	for i := range fxs {
+		pos, offset := uint64(0), uint64(0)
+		if err := ew.Write(&serialize.Entry{Fx: fxs[i], Pos: &pos, Offset: &offset}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ew.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := os.Create(filepath.Join(dir, "plot.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dst.Close() })
+	headerLen, err := WriteHeader(dst, k, bytes.Repeat([]byte{1}, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableStart := headerLen + 1
+	ew = serialize.NewEntryWriter(dst, int64(tableStart), k, serialize.CompressedTable)
+	for i := range fxs {
+		pos := uint64(i)
+		if err := ew.Write(&serialize.Entry{Pos: &pos}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ew.WriteEOT(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ew.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	tableEnd := int(ew.Offset())
+	if err := updateLastTableIndexAndPositions(dst, 7, tableStart, tableEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Checkpoint(context.Background(), src, dst, k, 0, len(fxs), 7, tableEnd+1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := updatePhase(dst, compressionPhase); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateFlags(dst, CompressedFlag); err != nil {
+		t.Fatal(err)
+	}
+
+	plot, err := newPlotReader(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plot
+}
+
+// randomOutputs returns n sorted outputs of table 7, with many outputs
+// sharing their first k bits.
+func randomOutputs(r *rand.Rand, k, n int) []uint64 {
+	fxs := make([]uint64, n)
+	for i := range fxs {
+		fxs[i] = uint64(r.Int63n(1 << (k + parameters.ParamEXT)))
+	}
+	sort.Slice(fxs, func(i, j int) bool { return fxs[i] < fxs[j] })
+	return fxs
+}
+
+func TestLookupPark(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	k := 18
+	fxs := randomOutputs(r, k, 20*parameters.ParamC1+123)
+	plot := writeCheckpointedPlot(t, k, fxs)
+
+	var nonZero int
+	for i := 0; i < 500; i++ {
+		target := uint64(r.Int63n(1 << k))
+		// Outputs matching target start at the first output that is
+		// not smaller than it, which is found in the last park that
+		// starts with an output smaller than target.
+		first := sort.Search(len(fxs), func(i int) bool { return outputTarget(fxs[i]) >= target })
+		var expected uint64
+		if first > 0 {
+			expected = uint64(first-1) / parameters.ParamC1
+		}
+		_, park, err := plot.lookupPark(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if park != expected {
+			t.Fatalf("target %d: expected to start from park %d, got %d", target, expected, park)
+		}
+		if park > 0 {
+			nonZero++
+		}
+	}
+	if nonZero == 0 {
+		t.Errorf("expected lookups to start past the first park")
+	}
+}
+
+func TestLookupMatches(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	k := 18
+	fxs := randomOutputs(r, k, 20*parameters.ParamC1+123)
+	plot := writeCheckpointedPlot(t, k, fxs)
+
+	var total int
+	for i := 0; i < 300; i++ {
+		var challenge [32]byte
+		r.Read(challenge[:])
+		// Also look up targets that are known to be in the plot.
+		if i%2 == 0 {
+			binary.BigEndian.PutUint64(challenge[:], outputTarget(fxs[r.Intn(len(fxs))])<<(64-k))
+		}
+		target := challengeTarget(challenge[:], k)
+		var expected int
+		for _, fx := range fxs {
+			if outputTarget(fx) == target {
+				expected++
+			}
+		}
+
+		matches, got, err := plot.findMatches(challenge[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != target {
+			t.Fatalf("expected target %d, got %d", target, got)
+		}
+		if len(matches) != expected {
+			t.Fatalf("target %d: expected %d matches, got %d", target, expected, len(matches))
+		}
+		for _, m := range matches {
+			if outputTarget(fxs[*m.Pos]) != target {
+				t.Fatalf("target %d: unexpected match at %d", target, *m.Pos)
+			}
+		}
+		total += expected
+	}
+	if total == 0 {
+		t.Errorf("expected some targets to match")
+	}
+}
+
+func TestProveAll(t *testing.T) {
+	k := 16
+	id := bytes.Repeat([]byte{1}, 32)
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+
+	opts := PlotOptions{AvailableMemory: 1 << 30, Threads: 2, Logger: log.New(io.Discard, "", 0)}
+	if _, err := PlotDisk(context.Background(), plotPath, k, id, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read every output of table 7 to count matches by brute force.
+	plot, err := openPlotReader(plotPath, "os")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3, err := serialize.ReadParkTable(plot.file, int64(plot.tables[c3Table-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fxs []uint64
+	for park := 0; uint64(park)*parameters.ParamC1 < c3.NumEntries(); park++ {
+		values, err := c3.Park(plot.file, park)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fx := range values {
+			fxs = append(fxs, fx.Lo)
+		}
+	}
+	plot.file.Close()
+
+	r := rand.New(rand.NewSource(3))
+	var total int
+	for i := 0; i < 200; i++ {
+		challenge := CheckChallenge([]byte("seed"), i)
+		// Half the challenges target outputs known to be in the plot.
+		if i%2 == 0 {
+			target := outputTarget(fxs[r.Intn(len(fxs))])
+			binary.BigEndian.PutUint64(challenge, target<<(64-k)|uint64(r.Int63n(1<<(64-k))))
+		}
+		target := challengeTarget(challenge, k)
+		var expected int
+		for _, fx := range fxs {
+			if outputTarget(fx) == target {
+				expected++
+			}
+		}
+
+		num, err := NumProofs(plotPath, "os", challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if num != expected {
+			t.Fatalf("challenge %x: expected %d proofs, NumProofs returned %d", challenge, expected, num)
+		}
+		proofs, err := ProveAll(plotPath, "os", challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proofs) != expected {
+			t.Fatalf("challenge %x: expected %d proofs, ProveAll returned %d", challenge, expected, len(proofs))
+		}
+		for j, proof := range proofs {
+			if proof.K != k {
+				t.Fatalf("challenge %x: expected proof %d for k=%d, got k=%d", challenge, j, k, proof.K)
+			}
+			if err := Verify(string(challenge), id, k, proof.X); err != nil {
+				t.Fatalf("challenge %x: proof %d: %v", challenge, j, err)
+			}
+		}
+		total += expected
+	}
+	if total == 0 {
+		t.Errorf("expected some challenges to have proofs")
+	}
+}
+
+func TestProveChallengeSize(t *testing.T) {
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+	for _, challenge := range [][]byte{nil, make([]byte, 31), make([]byte, 33)} {
+		calls := map[string]func() error{
+			"Prove": func() error {
+				_, err := Prove(plotPath, "os", challenge)
+				return err
+			},
+			"NumProofs": func() error {
+				_, err := NumProofs(plotPath, "os", challenge)
+				return err
+			},
+			"GetFullProof": func() error {
+				_, err := GetFullProof(plotPath, "os", challenge, 0)
+				return err
+			},
+			"ProveAll": func() error {
+				_, err := ProveAll(plotPath, "os", challenge)
+				return err
+			},
+			"GetQualitiesForChallenge": func() error {
+				_, err := GetQualitiesForChallenge(plotPath, "os", challenge)
+				return err
+			},
+		}
+		for name, call := range calls {
+			if err := call(); err == nil || !strings.Contains(err.Error(), "needs to be 32") {
+				t.Errorf("%s: expected a %d-byte challenge to be rejected, got %v", name, len(challenge), err)
+			}
+		}
+	}
+}
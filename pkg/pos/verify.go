@@ -2,43 +2,116 @@ package pos
 
 import (
 	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"math"
-	"math/big"
-	"math/bits"
 
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
 	"github.com/kargakis/chiapos/pkg/serialize"
-	"github.com/kargakis/chiapos/pkg/utils"
+	bitsutil "github.com/kargakis/chiapos/pkg/utils/bits"
 )
 
+// challengeSize is the size in bytes of the challenges
+// proofs are looked up and quality strings computed for.
+const challengeSize = 32
+
+// validateChallenge checks that challenge is challengeSize bytes long.
+func validateChallenge(challenge []byte) error {
+	if len(challenge) != challengeSize {
+		return fmt.Errorf("challenge is %d bytes; needs to be %d", len(challenge), challengeSize)
+	}
+	return nil
+}
+
+// challengeTarget returns the first k bits of the challenge, which the
+// outputs of table 7 of the proofs for the challenge start with.
+func challengeTarget(challenge []byte, k int) uint64 {
+	var first [8]byte
+	copy(first[:], challenge)
+	return binary.BigEndian.Uint64(first[:]) >> (64 - k)
+}
+
+// outputTarget returns the first k bits of an output of table 7, which is
+// k+ParamEXT bits long. Outputs are sorted by their first k bits as well,
+// so they can be compared against the target of a challenge.
+func outputTarget(fx uint64) uint64 {
+	return fx >> parameters.ParamEXT
+}
+
+// ParseChallenge parses a hex-encoded challenge of exactly 32 bytes.
+func ParseChallenge(s string) ([32]byte, error) {
+	var challenge [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return challenge, fmt.Errorf("invalid challenge: %w", err)
+	}
+	if err := validateChallenge(b); err != nil {
+		return challenge, err
+	}
+	copy(challenge[:], b)
+	return challenge, nil
+}
+
+// VerifyProof verifies the provided proof, packed with PackProof, for the
+// challenge given the id and k of the plot it got retrieved out of, and
+// returns its quality string.
+func VerifyProof(plotID [32]byte, k uint8, challenge [32]byte, proof []byte) ([]byte, error) {
+	sp, err := UnpackProof(proof, int(k))
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(string(challenge[:]), plotID[:], int(k), sp.X); err != nil {
+		return nil, err
+	}
+	return GetQuality(challenge[:], int(k), sp.X)
+}
+
 // Verify verifies the provided proof given the challenge, seed, and k.
 func Verify(challenge string, seed []byte, k int, proof []uint64) error {
+	return verify(challenge, seed, k, proof, false)
+}
+
+// VerifyLegacy verifies the provided proof of a legacy plot given the
+// challenge, seed, and k. Legacy plots got created with f functions that
+// drop leading zero bits from their outputs, so their proofs do not pass
+// Verify.
+func VerifyLegacy(challenge string, seed []byte, k int, proof []uint64) error {
+	return verify(challenge, seed, k, proof, true)
+}
+
+func verify(challenge string, seed []byte, k int, proof []uint64, legacy bool) error {
 	if len(proof) != 64 {
 		return fmt.Errorf("invalid proof length: expected 64 values, got %d", len(proof))
 	}
 
-	f1, err := NewF1(k, seed)
+	newF1, newFx := NewF1, NewFx
+	if legacy {
+		newF1, newFx = newLegacyF1, newLegacyFx
+	}
+	f1, err := newF1(k, seed)
 	if err != nil {
 		return err
 	}
 
 	var fxs []uint64
-	var metadata []*big.Int
+	var metadata []encoding.Metadata
 	for _, x := range proof {
 		fx := f1.CalculateOne(x)
 		fxs = append(fxs, fx)
-		// TODO: Converting to an int64 (as opposed to uint64) may be problematic for large k?
-		metadata = append(metadata, big.NewInt(int64(x)))
+		metadata = append(metadata, encoding.NewMetadata(x))
 	}
 
-	fx, err := NewFx(k, seed)
+	fx, err := newFx(k, seed)
 	if err != nil {
 		return err
 	}
 
 	for t := 2; t <= 7; t++ {
 		var newFxs []uint64
-		var newMetadata []*big.Int
+		var newMetadata []encoding.Metadata
 		for i := 0; i < int(math.Pow(float64(2), float64(7-t))); i++ {
 			leftIndex := i * 2
 			rightIndex := leftIndex + 1
@@ -67,19 +140,101 @@ func Verify(challenge string, seed []byte, k int, proof []uint64) error {
 		metadata = newMetadata
 	}
 
-	// Now truncate both the challenge and the f7 output
-	// and see whether the space proof is valid.
-	challBig := new(big.Int).SetBytes([]byte(challenge))
-	challBig = utils.Trunc(challBig, 0, k, challBig.BitLen())
-	target := challBig.Uint64()
-	fEntry := utils.TruncPrimitive(fxs[0], 0, k, bits.Len64(fxs[0]))
-	if fEntry != target {
+	// The space proof is valid if the first k bits of
+	// the f7 output match the ones of the challenge.
+	if outputTarget(fxs[0]) != challengeTarget([]byte(challenge), k) {
 		return fmt.Errorf("invalid proof: f7 output does not match the provided challenge")
 	}
 
 	return nil
 }
 
+// GetQuality returns the quality string of the provided proof given the
+// challenge and k. The proof is expected to be valid for the challenge,
+// with its x values ordered the same way Prove returns them, so this does
+// not verify the proof. The quality string is the same the prover computes
+// out of the plot.
+func GetQuality(challenge []byte, k int, proof []uint64) ([]byte, error) {
+	if err := validateChallenge(challenge); err != nil {
+		return nil, err
+	}
+	if len(proof) != 64 {
+		return nil, fmt.Errorf("invalid proof length: expected 64 values, got %d", len(proof))
+	}
+
+	// Follow the same path the prover follows in the plot, where
+	// every half of the proof is found at the position its line
+	// point got sorted in.
+	xs := proof
+	for t := 6; t >= 2; t-- {
+		larger, smaller := orderSubproof(xs)
+		xs = smaller
+		if qualityBit(challenge, t) {
+			xs = larger
+		}
+	}
+	x1, x2 := xs[0], xs[1]
+	if x1 < x2 {
+		x1, x2 = x2, x1
+	}
+	return qualityString(challenge, k, x1, x2), nil
+}
+
+// lessSubproof reports whether the line point of the entry that the x values
+// of a end up in is smaller than the one of b, where a and b are the same size.
+// Line points are compared by their larger value first, and positions in the
+// compressed tables follow the order of the line points they hold, so line
+// points can be compared without knowing the actual positions.
+func lessSubproof(a, b []uint64) bool {
+	if len(a) == 1 {
+		return a[0] < b[0]
+	}
+	aLarger, aSmaller := orderSubproof(a)
+	bLarger, bSmaller := orderSubproof(b)
+	if !equalSubproof(aLarger, bLarger) {
+		return lessSubproof(aLarger, bLarger)
+	}
+	return lessSubproof(aSmaller, bSmaller)
+}
+
+// orderSubproof splits the provided x values in the two halves that got
+// matched, and returns the one with the larger line point first.
+func orderSubproof(xs []uint64) ([]uint64, []uint64) {
+	left, right := xs[:len(xs)/2], xs[len(xs)/2:]
+	if lessSubproof(left, right) {
+		return right, left
+	}
+	return left, right
+}
+
+func equalSubproof(a, b []uint64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// qualityBit returns the bit of the challenge that selects which
+// value of the line point to follow in table t, where the last
+// five bits of the challenge are used for tables 2-6.
+func qualityBit(challenge []byte, t int) bool {
+	return (challenge[len(challenge)-1]>>(t-2))&1 == 1
+}
+
+// qualityString hashes the challenge along with the two x values of a
+// proof that the challenge selects, where x1 is the larger of the two.
+func qualityString(challenge []byte, k int, x1, x2 uint64) []byte {
+	w := bitsutil.NewWriter(bitsutil.ToBytes(2 * k))
+	w.WriteUint64(x2, k)
+	w.WriteUint64(x1, k)
+	h := sha256.New()
+	h.Write(challenge)
+	h.Write(w.Bytes())
+	return h.Sum(nil)
+}
+
 // findBucketAndPosForX returns the first item of x's bucket and
 // the position of x in the bucket.
 func findBucketAndPosForX(x uint64) (uint64, int) {
@@ -0,0 +1,144 @@
+package pos
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+)
+
+func TestLessSubproof(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// Entries of table 2 have line points made of x values.
+	pairs := make([][]uint64, 50)
+	for i := range pairs {
+		x := uint64(r.Intn(1 << 10))
+		pairs[i] = []uint64{x, x + 1 + uint64(r.Intn(1<<10))}
+		if r.Intn(2) == 0 {
+			pairs[i][0], pairs[i][1] = pairs[i][1], pairs[i][0]
+		}
+	}
+	pairPoint := func(p []uint64) encoding.LinePoint {
+		return encoding.SquareToLinePoint(p[0], p[1])
+	}
+	for i := range pairs {
+		for j := range pairs {
+			if i == j {
+				continue
+			}
+			expected := pairPoint(pairs[i]).Less(pairPoint(pairs[j]))
+			if got := lessSubproof(pairs[i], pairs[j]); got != expected {
+				t.Fatalf("pairs %v and %v: expected %t, got %t", pairs[i], pairs[j], expected, got)
+			}
+		}
+	}
+
+	// Entries of table 3 have line points made of the positions
+	// of the entries of table 2, which are sorted by line point.
+	sort.Slice(pairs, func(i, j int) bool { return pairPoint(pairs[i]).Less(pairPoint(pairs[j])) })
+	var quads [][]uint64
+	var quadPoints []encoding.LinePoint
+	for i := 0; i < 30; i++ {
+		a, b := r.Intn(len(pairs)), r.Intn(len(pairs))
+		if a == b {
+			continue
+		}
+		quads = append(quads, append(append([]uint64{}, pairs[a]...), pairs[b]...))
+		quadPoints = append(quadPoints, encoding.SquareToLinePoint(uint64(a), uint64(b)))
+	}
+	for i := range quads {
+		for j := range quads {
+			if quadPoints[i] == quadPoints[j] {
+				continue
+			}
+			expected := quadPoints[i].Less(quadPoints[j])
+			if got := lessSubproof(quads[i], quads[j]); got != expected {
+				t.Fatalf("quads %v and %v: expected %t, got %t", quads[i], quads[j], expected, got)
+			}
+		}
+	}
+}
+
+func TestVerifyProof(t *testing.T) {
+	k := 16
+	var id [32]byte
+	copy(id[:], bytes.Repeat([]byte{1}, 32))
+	plotPath := filepath.Join(t.TempDir(), "plot.dat")
+
+	opts := PlotOptions{AvailableMemory: 1 << 30, Threads: 2, Logger: log.New(io.Discard, "", 0)}
+	if _, err := PlotDisk(context.Background(), plotPath, k, id[:], opts); err != nil {
+		t.Fatal(err)
+	}
+
+	var challenge [32]byte
+	var proofs []SpaceProof
+	for i := 0; len(proofs) == 0; i++ {
+		if i == 10000 {
+			t.Fatal("no proof found")
+		}
+		copy(challenge[:], CheckChallenge([]byte("seed"), i))
+		var err error
+		if proofs, err = ProveAll(plotPath, "os", challenge[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qualities, err := GetQualitiesForChallenge(plotPath, "os", challenge[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := proofs[0].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	quality, err := VerifyProof(id, uint8(k), challenge, proof)
+	if err != nil {
+		t.Fatalf("cannot verify proof: %v", err)
+	}
+	if !bytes.Equal(quality, qualities[0]) {
+		t.Errorf("expected quality %x, got %x", qualities[0], quality)
+	}
+
+	otherChallenge := challenge
+	otherChallenge[0] ^= 0xff
+	if _, err := VerifyProof(id, uint8(k), otherChallenge, proof); err == nil {
+		t.Errorf("expected proof to fail verification for another challenge")
+	}
+	if _, err := VerifyProof(id, uint8(k+1), challenge, proof); err == nil {
+		t.Errorf("expected proof to fail verification for another k")
+	}
+	proof[0] ^= 0xff
+	if _, err := VerifyProof(id, uint8(k), challenge, proof); err == nil {
+		t.Errorf("expected corrupted proof to fail verification")
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	// Proof retrieved for the challenge below out of a k=16
+	// plot created before the plot header got versioned.
+	id := []byte("0000000000000000legacy plot seed")
+	challenge := "03-legacy-challenge-000000000000"
+	proof := []uint64{
+		63428, 11351, 33994, 8599, 61541, 36988, 17862, 39951, 64563, 56990, 38797, 26009, 20316, 50626, 40233, 7038,
+		18717, 9544, 65056, 14398, 46233, 28310, 14444, 7684, 23578, 30830, 51019, 6765, 20370, 55436, 48139, 45783,
+		34246, 38223, 5417, 19727, 39194, 6952, 6440, 12938, 34734, 4797, 53758, 48283, 81, 57882, 51235, 46103,
+		63705, 34238, 30121, 61226, 49828, 38630, 52017, 47717, 8536, 51889, 4011, 16037, 29430, 55246, 17335, 18627,
+	}
+	if err := VerifyLegacy(challenge, id, 16, proof); err != nil {
+		t.Fatalf("cannot verify proof of legacy plot: %v", err)
+	}
+	if err := Verify(challenge, id, 16, proof); err == nil {
+		t.Errorf("expected proof of legacy plot to fail verification with the current f functions")
+	}
+	proof[0] ^= 1
+	if err := VerifyLegacy(challenge, id, 16, proof); err == nil {
+		t.Errorf("expected corrupted proof to fail verification")
+	}
+}
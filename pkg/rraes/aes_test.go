@@ -5,6 +5,8 @@
 package rraes
 
 import (
+	"bytes"
+	"math/rand"
 	"testing"
 )
 
@@ -143,8 +145,18 @@ var encryptTests = []CryptTest{
 
 // Test Cipher Encrypt method against FIPS 197 examples.
 func TestCipherEncrypt(t *testing.T) {
+	testCipherEncrypt(t, NewCipher)
+}
+
+// Test the pure Go implementation against the same examples, so
+// it is covered even where an assembly implementation is used.
+func TestCipherEncryptGeneric(t *testing.T) {
+	testCipherEncrypt(t, newCipherGeneric)
+}
+
+func testCipherEncrypt(t *testing.T, newCipher func([]byte) (Block, error)) {
 	for i, tt := range encryptTests {
-		c, err := NewCipher(tt.key)
+		c, err := newCipher(tt.key)
 		if err != nil {
 			t.Errorf("NewCipher(%d bytes) = %s", len(tt.key), err)
 			continue
@@ -160,6 +172,63 @@ func TestCipherEncrypt(t *testing.T) {
 	}
 }
 
+// Test that the pure Go implementation matches the
+// default one on random keys and inputs.
+func TestCipherEncryptRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key, in := make([]byte, 16), make([]byte, BlockSize)
+	out, expected := make([]byte, BlockSize), make([]byte, BlockSize)
+	for i := 0; i < 1000; i++ {
+		r.Read(key)
+		r.Read(in)
+		c, err := NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generic, err := newCipherGeneric(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Encrypt(expected, in)
+		generic.Encrypt(out, in)
+		if !bytes.Equal(out, expected) {
+			t.Fatalf("key %x, input %x: expected %x, got %x", key, in, expected, out)
+		}
+	}
+}
+
+// Test that encrypting multiple blocks at once matches encrypting
+// them one by one, for any number of blocks and in place.
+func TestCipherEncryptBlocks(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	key := make([]byte, 16)
+	r.Read(key)
+	for _, newCipher := range []func([]byte) (Block, error){NewCipher, newCipherGeneric} {
+		c, err := newCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n <= 11; n++ {
+			in := make([]byte, n*BlockSize)
+			r.Read(in)
+			expected := make([]byte, len(in))
+			for i := 0; i < len(in); i += BlockSize {
+				c.Encrypt(expected[i:], in[i:])
+			}
+
+			out := make([]byte, len(in))
+			c.EncryptBlocks(out, in)
+			if !bytes.Equal(out, expected) {
+				t.Fatalf("%d blocks: expected %x, got %x", n, expected, out)
+			}
+			c.EncryptBlocks(in, in)
+			if !bytes.Equal(in, expected) {
+				t.Fatalf("%d blocks in place: expected %x, got %x", n, expected, in)
+			}
+		}
+	}
+}
+
 // Test short input/output.
 // Assembly used to not notice.
 // See issue 7928.
@@ -174,6 +243,8 @@ func TestShortBlocks(t *testing.T) {
 	mustPanic(t, "rraes: decryption not implemented", func() { c.Decrypt(bytes(100), bytes(1)) })
 	mustPanic(t, "rraes: output not full block", func() { c.Encrypt(bytes(1), bytes(100)) })
 	mustPanic(t, "rraes: decryption not implemented", func() { c.Decrypt(bytes(1), bytes(100)) })
+	mustPanic(t, "rraes: input not full blocks", func() { c.EncryptBlocks(bytes(32), bytes(17)) })
+	mustPanic(t, "rraes: output smaller than input", func() { c.EncryptBlocks(bytes(16), bytes(32)) })
 }
 
 func mustPanic(t *testing.T, msg string, f func()) {
@@ -202,6 +273,20 @@ func BenchmarkEncrypt(b *testing.B) {
 	}
 }
 
+func BenchmarkEncryptBlocks(b *testing.B) {
+	tt := encryptTests[0]
+	c, err := NewCipher(tt.key)
+	if err != nil {
+		b.Fatal("NewCipher:", err)
+	}
+	out := make([]byte, 1024*BlockSize)
+	b.SetBytes(int64(len(out)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.EncryptBlocks(out, out)
+	}
+}
+
 func BenchmarkExpand(b *testing.B) {
 	tt := encryptTests[0]
 	n := len(tt.key) + 28
@@ -2,6 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+//go:build !purego
+
 #include "textflag.h"
 
 // func encryptBlockAsm(nr int, xk *uint32, dst, src *byte)
@@ -23,6 +25,59 @@ TEXT ·encryptBlockAsm(SB),NOSPLIT,$0
 	MOVUPS X0, 0(DX)
 	RET
 
+// func encryptBlocksAsm(nr int, xk *uint32, dst, src *byte, n int)
+// Blocks are encrypted four at a time, interleaving the AES-NI
+// instructions of independent blocks to hide their latency.
+TEXT ·encryptBlocksAsm(SB),NOSPLIT,$0
+	MOVQ xk+8(FP), AX
+	MOVQ dst+16(FP), DX
+	MOVQ src+24(FP), BX
+	MOVQ n+32(FP), CX
+	MOVUPS 0(AX), X4
+	MOVUPS 16(AX), X5
+	MOVUPS 32(AX), X6
+Lenc4:
+	CMPQ CX, $4
+	JB Lenc1
+	MOVUPS 0(BX), X0
+	MOVUPS 16(BX), X1
+	MOVUPS 32(BX), X2
+	MOVUPS 48(BX), X3
+	PXOR X4, X0
+	PXOR X4, X1
+	PXOR X4, X2
+	PXOR X4, X3
+	AESENC X5, X0
+	AESENC X5, X1
+	AESENC X5, X2
+	AESENC X5, X3
+	AESENC X6, X0
+	AESENC X6, X1
+	AESENC X6, X2
+	AESENC X6, X3
+	MOVUPS X0, 0(DX)
+	MOVUPS X1, 16(DX)
+	MOVUPS X2, 32(DX)
+	MOVUPS X3, 48(DX)
+	ADDQ $64, BX
+	ADDQ $64, DX
+	SUBQ $4, CX
+	JMP Lenc4
+Lenc1:
+	TESTQ CX, CX
+	JZ Lenc_done
+	MOVUPS 0(BX), X0
+	PXOR X4, X0
+	AESENC X5, X0
+	AESENC X6, X0
+	MOVUPS X0, 0(DX)
+	ADDQ $16, BX
+	ADDQ $16, DX
+	DECQ CX
+	JMP Lenc1
+Lenc_done:
+	RET
+
 // func expandKeyAsm(nr int, key *byte, enc, dec *uint32) {
 // Note that round keys are stored in uint128 format, not uint32
 TEXT ·expandKeyAsm(SB),NOSPLIT,$0
@@ -24,20 +24,69 @@ func (k KeySizeError) Error() string {
 	return "crypto/aes: invalid key size " + strconv.Itoa(int(k))
 }
 
-// NewCipher creates and returns a new cipher.Block.
+// Block is a cipher.Block that can also encrypt multiple
+// consecutive blocks with a single call.
+type Block interface {
+	cipher.Block
+	// EncryptBlocks encrypts every block of src into the
+	// corresponding block of dst. src must be a multiple of
+	// BlockSize, and dst and src must overlap entirely or
+	// not at all.
+	EncryptBlocks(dst, src []byte)
+}
+
+// NewCipher creates and returns a new Block.
 // The key argument should be the AES key,
 // 16 bytes long, to select AES-128.
-func NewCipher(key []byte) (cipher.Block, error) {
+func NewCipher(key []byte) (Block, error) {
 	if k := len(key); k != 16 {
 		return nil, KeySizeError(k)
 	}
 	return newCipher(key)
 }
 
+// newCipherGeneric creates and returns a new Block
+// implemented in pure Go.
+func newCipherGeneric(key []byte) (Block, error) {
+	n := len(key) + 28
+	c := aesCipher{make([]uint32, n), make([]uint32, n)}
+	expandKeyGo(key, c.enc, c.dec)
+	return &c, nil
+}
+
 func (c *aesCipher) BlockSize() int { return BlockSize }
 
 func (c *aesCipher) Encrypt(dst, src []byte) {
-	panic("rraes: golang encryption not implemented")
+	if len(src) < BlockSize {
+		panic("rraes: input not full block")
+	}
+	if len(dst) < BlockSize {
+		panic("rraes: output not full block")
+	}
+	if InexactOverlap(dst[:BlockSize], src[:BlockSize]) {
+		panic("rraes: invalid buffer overlap")
+	}
+	encryptBlockGo(c.enc, dst, src)
+}
+
+func (c *aesCipher) EncryptBlocks(dst, src []byte) {
+	checkBlocks(dst, src)
+	for i := 0; i < len(src); i += BlockSize {
+		encryptBlockGo(c.enc, dst[i:], src[i:])
+	}
+}
+
+// checkBlocks panics if dst and src cannot be passed to EncryptBlocks.
+func checkBlocks(dst, src []byte) {
+	if len(src)%BlockSize != 0 {
+		panic("rraes: input not full blocks")
+	}
+	if len(dst) < len(src) {
+		panic("rraes: output smaller than input")
+	}
+	if InexactOverlap(dst[:len(src)], src) {
+		panic("rraes: invalid buffer overlap")
+	}
 }
 
 func (c *aesCipher) Decrypt(dst, src []byte) {
@@ -2,17 +2,18 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package rraes
+//go:build amd64 && !purego
 
-import (
-	"crypto/cipher"
-)
+package rraes
 
 // defined in asm_*.s
 
 //go:noescape
 func encryptBlockAsm(nr int, xk *uint32, dst, src *byte)
 
+//go:noescape
+func encryptBlocksAsm(nr int, xk *uint32, dst, src *byte, n int)
+
 //go:noescape
 func expandKeyAsm(nr int, key *byte, enc *uint32, dec *uint32)
 
@@ -20,7 +21,7 @@ type aesCipherAsm struct {
 	aesCipher
 }
 
-func newCipher(key []byte) (cipher.Block, error) {
+func newCipher(key []byte) (Block, error) {
 	n := len(key) + 28
 	c := aesCipherAsm{aesCipher{make([]uint32, n), make([]uint32, n)}}
 
@@ -43,6 +44,14 @@ func (c *aesCipherAsm) Encrypt(dst, src []byte) {
 	encryptBlockAsm(len(c.enc)/4-1, &c.enc[0], &dst[0], &src[0])
 }
 
+func (c *aesCipherAsm) EncryptBlocks(dst, src []byte) {
+	checkBlocks(dst, src)
+	if len(src) == 0 {
+		return
+	}
+	encryptBlocksAsm(len(c.enc)/4-1, &c.enc[0], &dst[0], &src[0], len(src)/BlockSize)
+}
+
 func (c *aesCipherAsm) Decrypt(dst, src []byte) {
 	panic("rraes: decryption not implemented")
 }
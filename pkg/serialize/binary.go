@@ -0,0 +1,332 @@
+package serialize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
+	bitsutil "github.com/kargakis/chiapos/pkg/utils/bits"
+)
+
+// PosSize returns the size of a position in bits. Positions
+// are stored in k+1 bits because some of the tables may have
+// more than 2^k entries.
+func PosSize(k int) int {
+	return k + 1
+}
+
+// entryBits returns the number of bits a binary entry of table
+// t occupies.
+func entryBits(k, t int) int {
+	fxBits := k + parameters.ParamEXT
+	switch t {
+	case 1:
+		return fxBits + k
+	case 2, 3, 4, 5, 6:
+		return fxBits + PosSize(k) + parameters.ParamOffsetSize + CollaSize(t+1)*k
+	case 7:
+		return fxBits + PosSize(k) + parameters.ParamOffsetSize
+	case CheckpointTable:
+		return fxBits + PosSize(k)
+	case CompressedTable:
+		return PosSize(k)
+	case LinePointTable:
+		return linePointBits(k) + PosSize(k)
+	case PositionTable:
+		return PosSize(k) + parameters.ParamOffsetSize + PosSize(k)
+	}
+	return 0
+}
+
+// hasOutput reports whether entries of table t start with an output.
+func hasOutput(t int) bool {
+	return t != CompressedTable && t != LinePointTable && t != PositionTable
+}
+
+// SortKeyBits returns the size in bits of the field binary entries of
+// table t start with, which is the field they are sorted by first.
+func SortKeyBits(k, t int) int {
+	switch t {
+	case LinePointTable:
+		return linePointBits(k)
+	case CompressedTable, PositionTable:
+		return PosSize(k)
+	}
+	return k + parameters.ParamEXT
+}
+
+// EntrySize returns the size of a binary entry in bytes depending
+// on the space parameter k and the table index t.
+func EntrySize(k, t int) int {
+	return bitsutil.ToBytes(entryBits(k, t))
+}
+
+// Write serializes a table entry of table t in file using the binary
+// format. All entries of a table have the same size, and fields are
+// packed one after the other, most significant bit first:
+//
+//	table 1:    f(x) (k+ParamEXT bits), x (k bits)
+//	table 2-6:  f(x) (k+ParamEXT bits), pos (k+1 bits), offset (ParamOffsetSize bits),
+//	            collated (CollaSize(t+1)*k bits)
+//	table 7:    f(x) (k+ParamEXT bits), pos (k+1 bits), offset (ParamOffsetSize bits)
+//	checkpoint: f(x) (k+ParamEXT bits), pos (k+1 bits)
+//	compressed: pos (k+1 bits)
+//	line point: line point (2k+2 bits), pos (k+1 bits)
+//	position:   pos (k+1 bits), offset (ParamOffsetSize bits), index (k+1 bits)
+//
+// Any remaining bits in the last byte of the entry are zero.
+func Write(file afero.File, offset int64, e *Entry, k, t int) (int, error) {
+	buf, err := Encode(e, k, t)
+	if err != nil {
+		return 0, err
+	}
+	return file.WriteAt(buf, offset)
+}
+
+// Encode serializes a table entry of table t using the binary format.
+func Encode(e *Entry, k, t int) ([]byte, error) {
+	size := EntrySize(k, t)
+	if size == 0 {
+		return nil, fmt.Errorf("invalid table index %d", t)
+	}
+	w := bitsutil.NewWriter(size)
+
+	if hasOutput(t) {
+		if err := writeField(w, "f(x)", e.Fx, k+parameters.ParamEXT); err != nil {
+			return nil, err
+		}
+	}
+	switch t {
+	case LinePointTable:
+		if e.LinePoint == nil {
+			return nil, errors.New("missing line point")
+		}
+		if !fitsValue(*e.LinePoint, linePointBits(k)) {
+			return nil, fmt.Errorf("line point does not fit in %d bits", linePointBits(k))
+		}
+		writeValue(w, *e.LinePoint, linePointBits(k))
+		if e.Pos == nil {
+			return nil, errors.New("missing pos")
+		}
+		if err := writeField(w, "pos", *e.Pos, PosSize(k)); err != nil {
+			return nil, err
+		}
+
+	case PositionTable:
+		if e.Pos == nil || e.Offset == nil {
+			return nil, errors.New("missing pos or offset")
+		}
+		if err := writeField(w, "pos", *e.Pos, PosSize(k)); err != nil {
+			return nil, err
+		}
+		if err := writeField(w, "offset", *e.Offset, parameters.ParamOffsetSize); err != nil {
+			return nil, err
+		}
+		if err := writeField(w, "index", uint64(e.Index), PosSize(k)); err != nil {
+			return nil, err
+		}
+
+	case 1:
+		if e.X == nil {
+			return nil, errors.New("missing x")
+		}
+		if err := writeField(w, "x", *e.X, k); err != nil {
+			return nil, err
+		}
+
+	default:
+		if e.Pos == nil {
+			return nil, errors.New("missing pos")
+		}
+		if err := writeField(w, "pos", *e.Pos, PosSize(k)); err != nil {
+			return nil, err
+		}
+		if t == CheckpointTable || t == CompressedTable {
+			break
+		}
+
+		if e.Offset == nil {
+			return nil, errors.New("missing offset")
+		}
+		if err := writeField(w, "offset", *e.Offset, parameters.ParamOffsetSize); err != nil {
+			return nil, err
+		}
+		if t == 7 {
+			break
+		}
+
+		if e.Collated == nil {
+			return nil, errors.New("missing collated value")
+		}
+		collatedBits := CollaSize(t+1) * k
+		if e.Collated.BitLen() > collatedBits {
+			return nil, fmt.Errorf("collated value does not fit in %d bits", collatedBits)
+		}
+		// Collated values are written one word at a time, starting
+		// with the most significant one.
+		for n := collatedBits; n > 0; {
+			wordBits := (n-1)%64 + 1
+			n -= wordBits
+			w.WriteUint64(e.Collated[n/64], wordBits)
+		}
+	}
+
+	return w.Bytes(), nil
+}
+
+func writeField(w *bitsutil.Writer, name string, v uint64, size int) error {
+	if !bitsutil.IsAtMostKBits(v, uint64(size)) {
+		return fmt.Errorf("%s %d does not fit in %d bits", name, v, size)
+	}
+	w.WriteUint64(v, size)
+	return nil
+}
+
+// WriteEOT writes the last entry of table t that should signal that
+// we just finished reading the table. The EOT entry has all its bits
+// set. A valid entry can never look like that if it has padding bits,
+// since those are always zero, and otherwise it would require all of
+// its fields to be maxed out at the same time.
+func WriteEOT(file afero.File, offset int64, k, t int) (int, error) {
+	return file.WriteAt(bytes.Repeat([]byte{0xff}, EntrySize(k, t)), offset)
+}
+
+// writeBufferSize is the maximum number of bytes an EntryWriter
+// buffers before writing them out.
+const writeBufferSize = 1 << 20
+
+// EntryWriter buffers binary entries of a table and writes them
+// sequentially starting at a given offset.
+type EntryWriter struct {
+	w      io.WriterAt
+	offset int64
+	buf    []byte
+	k, t   int
+}
+
+// NewEntryWriter returns a writer for entries of table t
+// that are going to be written in w starting at offset.
+func NewEntryWriter(w io.WriterAt, offset int64, k, t int) *EntryWriter {
+	return &EntryWriter{w: w, offset: offset, k: k, t: t}
+}
+
+// Write buffers an entry, flushing the buffer if needed.
+func (ew *EntryWriter) Write(e *Entry) error {
+	b, err := Encode(e, ew.k, ew.t)
+	if err != nil {
+		return err
+	}
+	return ew.WriteBytes(b)
+}
+
+// WriteBytes buffers an already serialized entry, flushing the buffer if needed.
+func (ew *EntryWriter) WriteBytes(b []byte) error {
+	ew.buf = append(ew.buf, b...)
+	if len(ew.buf) >= writeBufferSize {
+		return ew.Flush()
+	}
+	return nil
+}
+
+// WriteEOT buffers an EOT entry.
+func (ew *EntryWriter) WriteEOT() error {
+	return ew.WriteBytes(bytes.Repeat([]byte{0xff}, EntrySize(ew.k, ew.t)))
+}
+
+// Flush writes any buffered entries.
+func (ew *EntryWriter) Flush() error {
+	n, err := ew.w.WriteAt(ew.buf, ew.offset)
+	ew.offset += int64(n)
+	ew.buf = ew.buf[:0]
+	return err
+}
+
+// Offset returns the offset the next entry is going to be written at.
+func (ew *EntryWriter) Offset() int64 {
+	return ew.offset + int64(len(ew.buf))
+}
+
+// Read deserializes a table entry of table t written in the binary
+// format. EOTErr is returned if the entry read is an EOT entry.
+func Read(file afero.File, offset int64, k, t int) (*Entry, int, error) {
+	size := EntrySize(k, t)
+	if size == 0 {
+		return nil, 0, fmt.Errorf("invalid table index %d", t)
+	}
+	buf := make([]byte, size)
+	read, err := file.ReadAt(buf, offset)
+	if read < size {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, read, err
+	}
+	entry, err := Decode(buf, k, t)
+	return entry, read, err
+}
+
+// Decode deserializes a binary entry of table t.
+func Decode(buf []byte, k, t int) (*Entry, error) {
+	if isEOT(buf) {
+		return nil, EOTErr
+	}
+
+	r := bitsutil.NewReader(buf)
+	entry := &Entry{}
+	switch t {
+	case LinePointTable:
+		lp := readValue(r, linePointBits(k))
+		pos := r.ReadUint64(PosSize(k))
+		entry.LinePoint, entry.Pos = &lp, &pos
+		return entry, nil
+	case PositionTable:
+		pos := r.ReadUint64(PosSize(k))
+		offset := r.ReadUint64(parameters.ParamOffsetSize)
+		entry.Pos, entry.Offset = &pos, &offset
+		entry.Index = int(r.ReadUint64(PosSize(k)))
+		return entry, nil
+	}
+	if hasOutput(t) {
+		entry.Fx = r.ReadUint64(k + parameters.ParamEXT)
+	}
+	if t == 1 {
+		x := r.ReadUint64(k)
+		entry.X = &x
+		return entry, nil
+	}
+
+	pos := r.ReadUint64(PosSize(k))
+	entry.Pos = &pos
+	if t == CheckpointTable || t == CompressedTable {
+		return entry, nil
+	}
+
+	posOffset := r.ReadUint64(parameters.ParamOffsetSize)
+	entry.Offset = &posOffset
+	if t == 7 {
+		return entry, nil
+	}
+
+	var collated encoding.Metadata
+	for n := CollaSize(t+1) * k; n > 0; {
+		wordBits := (n-1)%64 + 1
+		n -= wordBits
+		collated[n/64] = r.ReadUint64(wordBits)
+	}
+	entry.Collated = &collated
+	return entry, nil
+}
+
+func isEOT(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,422 @@
+package serialize
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
+	bitsutil "github.com/kargakis/chiapos/pkg/utils/bits"
+)
+
+// parkTableHeaderSize is the size in bytes of the header of a park table.
+const parkTableHeaderSize = 8 + 1 + 2 + 1 + 2 + 256*2
+
+// ParkTable is a table of sorted values stored in parks. Every park holds
+// up to a fixed number of values: the first value as is, followed by the
+// deltas between consecutive values. The least significant bits of every
+// delta, its stub, are stored as is, and the rest of the delta, which is
+// small, is ANS-encoded. Park tables store the line points of the compressed
+// tables and the outputs of table 7 in the C3 checkpoint table.
+//
+// The table starts with a header:
+//
+//	8 bytes   - number of values in the table
+//	1 byte    - size of the first value of a park in bits
+//	2 bytes   - number of values in every park
+//	1 byte    - size of the stubs in bits
+//	2 bytes   - maximum size of the encoded deltas of a park
+//	512 bytes - ANS frequencies of the small deltas, 2 bytes for every possible delta
+//
+// followed by the parks, which all have the same size:
+//
+//	value     - first value of the park
+//	stubs     - stubs of the rest of the values, padded to a byte
+//	2 bytes   - size of the encoded small deltas
+//	deltas    - encoded small deltas, padded to the maximum size
+type ParkTable struct {
+	start int64
+
+	numEntries     uint64
+	valueBits      int
+	entriesPerPark int
+	stubBits       int
+	deltasSize     int
+	ans            *encoding.ANS
+}
+
+// linePointBits returns the size in bits of a line point of two positions.
+func linePointBits(k int) int {
+	return 2 * PosSize(k)
+}
+
+// stubsSize returns the size in bytes of the first value and the stubs of a park.
+func (pt *ParkTable) stubsSize() int {
+	return bitsutil.ToBytes(pt.valueBits + (pt.entriesPerPark-1)*pt.stubBits)
+}
+
+// parkSize returns the size in bytes of a park.
+func (pt *ParkTable) parkSize() int {
+	return pt.stubsSize() + 2 + pt.deltasSize
+}
+
+// stubSize returns the size of the stubs for n values ranging from first
+// to last, based on the average delta between them.
+func stubSize(first, last encoding.LinePoint, n uint64) int {
+	if n < 2 {
+		return 0
+	}
+	span := float64(last.Hi-first.Hi)*math.Pow(2, 64) + float64(last.Lo) - float64(first.Lo)
+	avg := span / float64(n-1)
+	if avg >= math.Pow(2, 63) {
+		return 64 - parameters.ParamStubMinusBits
+	}
+	size := bits.Len64(uint64(avg)) - parameters.ParamStubMinusBits
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// ValueSource calls fn in order for every value to be stored in a park
+// table. Park tables are written in a few passes over their values, so
+// a ValueSource needs to provide the same values every time it is called.
+type ValueSource func(fn func(encoding.LinePoint) error) error
+
+// sliceValues returns a ValueSource over values held in memory.
+func sliceValues(values []encoding.LinePoint) ValueSource {
+	return func(fn func(encoding.LinePoint) error) error {
+		for _, v := range values {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WriteParkTable writes the provided line points, which should be sorted,
+// in a park table at offset. The total number of bytes written is returned.
+func WriteParkTable(w io.WriterAt, offset int64, k int, linePoints []encoding.LinePoint) (int, error) {
+	return WriteParkTableFrom(w, offset, k, sliceValues(linePoints))
+}
+
+// WriteParkTableFrom is like WriteParkTable, but reads the line points
+// from linePoints, so they do not need to fit in memory.
+func WriteParkTableFrom(w io.WriterAt, offset int64, k int, linePoints ValueSource) (int, error) {
+	return writeParks(w, offset, linePointBits(k), parameters.ParamEntriesPerPark, linePoints)
+}
+
+// WriteCheckpointParks writes the provided outputs of table 7, which should be
+// sorted, in a park table at offset, where every park holds the outputs found
+// between two consecutive C1 checkpoints. The total number of bytes written is
+// returned.
+func WriteCheckpointParks(w io.WriterAt, offset int64, k int, fxs []uint64) (int, error) {
+	return WriteCheckpointParksFrom(w, offset, k, func(fn func(encoding.LinePoint) error) error {
+		for _, fx := range fxs {
+			if err := fn(encoding.LinePoint{Lo: fx}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteCheckpointParksFrom is like WriteCheckpointParks, but reads the
+// outputs from fxs, so they do not need to fit in memory.
+func WriteCheckpointParksFrom(w io.WriterAt, offset int64, k int, fxs ValueSource) (int, error) {
+	return writeParks(w, offset, k+parameters.ParamEXT, parameters.ParamC1, fxs)
+}
+
+// writeParks writes the values provided by values in parks of entriesPerPark
+// values, where the first value of every park is stored in valueBits bits. The
+// values are read once to size the stubs, once to count the small deltas the
+// ANS frequencies are made of, once to size the encoded deltas of the parks,
+// and once more to write the parks, so only a park is held in memory at a time.
+func writeParks(w io.WriterAt, offset int64, valueBits, entriesPerPark int, values ValueSource) (int, error) {
+	pt := &ParkTable{
+		valueBits:      valueBits,
+		entriesPerPark: entriesPerPark,
+	}
+	var first, last encoding.LinePoint
+	err := values(func(v encoding.LinePoint) error {
+		if pt.numEntries == 0 {
+			first = v
+		} else if v.Less(last) {
+			return fmt.Errorf("value %d is smaller than the previous one", pt.numEntries)
+		}
+		last = v
+		pt.numEntries++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	pt.stubBits = stubSize(first, last, pt.numEntries)
+
+	counts := make([]uint64, 256)
+	err = pt.forEachPark(values, func(p int, first encoding.LinePoint, stubs []uint64, smallDeltas []byte) error {
+		for _, small := range smallDeltas {
+			counts[small]++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	freqs, err := encoding.NormalizeFrequencies(counts)
+	if err != nil {
+		return 0, err
+	}
+	ans, err := encoding.NewANS(freqs)
+	if err != nil {
+		return 0, err
+	}
+
+	err = pt.forEachPark(values, func(p int, first encoding.LinePoint, stubs []uint64, smallDeltas []byte) error {
+		deltas, err := ans.Encode(smallDeltas)
+		if err != nil {
+			return err
+		}
+		if len(deltas) > pt.deltasSize {
+			pt.deltasSize = len(deltas)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 0, parkTableHeaderSize)
+	header = append(header, bitsutil.Uint64ToBytes(pt.numEntries, 64)...)
+	header = append(header, byte(valueBits))
+	header = append(header, bitsutil.Uint64ToBytes(uint64(entriesPerPark), 16)...)
+	header = append(header, byte(pt.stubBits))
+	header = append(header, bitsutil.Uint64ToBytes(uint64(pt.deltasSize), 16)...)
+	for _, f := range freqs {
+		header = append(header, bitsutil.Uint64ToBytes(uint64(f), 16)...)
+	}
+	wrote, err := w.WriteAt(header, offset)
+	if err != nil {
+		return wrote, err
+	}
+
+	size := pt.parkSize()
+	buf := make([]byte, 0, writeBufferSize+size)
+	err = pt.forEachPark(values, func(p int, first encoding.LinePoint, stubs []uint64, smallDeltas []byte) error {
+		deltas, err := ans.Encode(smallDeltas)
+		if err != nil {
+			return err
+		}
+		park := make([]byte, size)
+
+		bw := bitsutil.NewWriter(pt.stubsSize())
+		writeValue(bw, first, valueBits)
+		for _, stub := range stubs {
+			bw.WriteUint64(stub, pt.stubBits)
+		}
+		copy(park, bw.Bytes())
+
+		deltasStart := pt.stubsSize()
+		copy(park[deltasStart:], bitsutil.Uint64ToBytes(uint64(len(deltas)), 16))
+		copy(park[deltasStart+2:], deltas)
+
+		buf = append(buf, park...)
+		if len(buf) >= writeBufferSize || p == pt.numParks()-1 {
+			more, err := w.WriteAt(buf, offset+int64(wrote))
+			wrote += more
+			if err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		return nil
+	})
+	return wrote, err
+}
+
+// forEachPark calls fn for every park of the values provided by values, with
+// the first value of the park and the stubs and small deltas of the deltas
+// between the rest of its values. Every delta is split into its stub, made of
+// its least significant bits, and the small delta that gets encoded.
+func (pt *ParkTable) forEachPark(values ValueSource, fn func(p int, first encoding.LinePoint, stubs []uint64, smallDeltas []byte) error) error {
+	stubMask := uint64(1)<<pt.stubBits - 1
+	stubs := make([]uint64, 0, pt.entriesPerPark-1)
+	smallDeltas := make([]byte, 0, pt.entriesPerPark-1)
+
+	var i uint64
+	var first, previous encoding.LinePoint
+	err := values(func(v encoding.LinePoint) error {
+		if i%uint64(pt.entriesPerPark) == 0 {
+			if i > 0 {
+				if err := fn(int(i/uint64(pt.entriesPerPark))-1, first, stubs, smallDeltas); err != nil {
+					return err
+				}
+			}
+			// The first value of every park is stored as is.
+			first = v
+			stubs, smallDeltas = stubs[:0], smallDeltas[:0]
+		} else {
+			delta, ok := v.Delta(previous)
+			if !ok || delta>>pt.stubBits >= 256 {
+				return fmt.Errorf("delta between values %d and %d is too large to encode", i-1, i)
+			}
+			stubs = append(stubs, delta&stubMask)
+			smallDeltas = append(smallDeltas, byte(delta>>pt.stubBits))
+		}
+		previous = v
+		i++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if i != pt.numEntries {
+		return fmt.Errorf("expected %d values, got %d", pt.numEntries, i)
+	}
+	if i == 0 {
+		return nil
+	}
+	return fn(pt.numParks()-1, first, stubs, smallDeltas)
+}
+
+// parkBounds returns the range of values stored in park p.
+func (pt *ParkTable) parkBounds(p int) (int, int) {
+	start := p * pt.entriesPerPark
+	end := start + pt.entriesPerPark
+	if end > int(pt.numEntries) {
+		end = int(pt.numEntries)
+	}
+	return start, end
+}
+
+// numParks returns the number of parks in the table.
+func (pt *ParkTable) numParks() int {
+	return (int(pt.numEntries) + pt.entriesPerPark - 1) / pt.entriesPerPark
+}
+
+func writeValue(w *bitsutil.Writer, v encoding.LinePoint, size int) {
+	if size > 64 {
+		w.WriteUint64(v.Hi, size-64)
+		w.WriteUint64(v.Lo, 64)
+		return
+	}
+	w.WriteUint64(v.Lo, size)
+}
+
+// fitsValue reports whether v fits in size bits.
+func fitsValue(v encoding.LinePoint, size int) bool {
+	if size > 64 {
+		return bits.Len64(v.Hi) <= size-64
+	}
+	return v.Hi == 0 && bits.Len64(v.Lo) <= size
+}
+
+func readValue(r *bitsutil.Reader, size int) encoding.LinePoint {
+	if size > 64 {
+		hi := r.ReadUint64(size - 64)
+		return encoding.LinePoint{Hi: hi, Lo: r.ReadUint64(64)}
+	}
+	return encoding.LinePoint{Lo: r.ReadUint64(size)}
+}
+
+// ReadParkTable reads the header of the park table found at offset.
+func ReadParkTable(r io.ReaderAt, offset int64) (*ParkTable, error) {
+	header := make([]byte, parkTableHeaderSize)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, fmt.Errorf("cannot read park table header: %w", err)
+	}
+
+	pt := &ParkTable{
+		start:          offset,
+		numEntries:     bitsutil.BytesToUint64(header[:8], 64),
+		valueBits:      int(header[8]),
+		entriesPerPark: int(bitsutil.BytesToUint64(header[9:11], 16)),
+		stubBits:       int(header[11]),
+		deltasSize:     int(bitsutil.BytesToUint64(header[12:14], 16)),
+	}
+	if pt.entriesPerPark == 0 {
+		return nil, errors.New("invalid park table header: parks cannot be empty")
+	}
+	freqs := make([]uint32, 256)
+	for i := range freqs {
+		freqs[i] = uint32(bitsutil.BytesToUint64(header[14+2*i:16+2*i], 16))
+	}
+	ans, err := encoding.NewANS(freqs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid park table header: %w", err)
+	}
+	pt.ans = ans
+	return pt, nil
+}
+
+// NumEntries returns the number of values in the table.
+func (pt *ParkTable) NumEntries() uint64 {
+	return pt.numEntries
+}
+
+// Size returns the size of the table in bytes.
+func (pt *ParkTable) Size() int {
+	return parkTableHeaderSize + pt.numParks()*pt.parkSize()
+}
+
+// LinePoint returns the value found at index by decoding
+// the park that holds it.
+func (pt *ParkTable) LinePoint(r io.ReaderAt, index uint64) (encoding.LinePoint, error) {
+	if index >= pt.numEntries {
+		return encoding.LinePoint{}, fmt.Errorf("value %d out of range: table has %d values", index, pt.numEntries)
+	}
+	park := int(index / uint64(pt.entriesPerPark))
+	values, err := pt.readPark(r, park, int(index%uint64(pt.entriesPerPark))+1)
+	if err != nil {
+		return encoding.LinePoint{}, err
+	}
+	return values[len(values)-1], nil
+}
+
+// Park returns all the values stored in park p.
+func (pt *ParkTable) Park(r io.ReaderAt, p int) ([]encoding.LinePoint, error) {
+	if p < 0 || p >= pt.numParks() {
+		return nil, fmt.Errorf("park %d out of range: table has %d parks", p, pt.numParks())
+	}
+	start, end := pt.parkBounds(p)
+	return pt.readPark(r, p, end-start)
+}
+
+// readPark decodes the first n values of park p.
+func (pt *ParkTable) readPark(r io.ReaderAt, p, n int) ([]encoding.LinePoint, error) {
+	size := pt.parkSize()
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, pt.start+parkTableHeaderSize+int64(p)*int64(size)); err != nil {
+		return nil, fmt.Errorf("cannot read park %d: %w", p, err)
+	}
+
+	br := bitsutil.NewReader(buf)
+	values := make([]encoding.LinePoint, n)
+	values[0] = readValue(br, pt.valueBits)
+	if n == 1 {
+		return values, nil
+	}
+
+	stubs := make([]uint64, n-1)
+	for i := range stubs {
+		stubs[i] = br.ReadUint64(pt.stubBits)
+	}
+
+	deltasStart := pt.stubsSize()
+	deltasLen := int(bitsutil.BytesToUint64(buf[deltasStart:deltasStart+2], 16))
+	if deltasLen > pt.deltasSize {
+		return nil, errors.New("invalid park: encoded deltas are too large")
+	}
+	smallDeltas, err := pt.ans.Decode(buf[deltasStart+2:deltasStart+2+deltasLen], n-1)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode park %d: %w", p, err)
+	}
+	for i, small := range smallDeltas {
+		values[i+1] = values[i].Add(uint64(small)<<pt.stubBits | stubs[i])
+	}
+	return values, nil
+}
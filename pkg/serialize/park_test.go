@@ -0,0 +1,120 @@
+package serialize
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
+)
+
+func TestParkTable(t *testing.T) {
+	k := 17
+	r := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{1, parameters.ParamEntriesPerPark, 3*parameters.ParamEntriesPerPark + 5} {
+		linePoints := make([]encoding.LinePoint, n)
+		for i := range linePoints {
+			x := uint64(r.Intn(1 << PosSize(k)))
+			y := uint64(r.Intn(1 << PosSize(k)))
+			if x == y {
+				y = x + 1
+			}
+			linePoints[i] = encoding.SquareToLinePoint(x, y)
+		}
+		sort.Slice(linePoints, func(i, j int) bool { return linePoints[i].Less(linePoints[j]) })
+
+		file, err := afero.NewMemMapFs().Create("TestParkTable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := int64(100)
+		wrote, err := WriteParkTable(file, offset, k, linePoints)
+		if err != nil {
+			t.Fatalf("cannot write %d line points: %v", n, err)
+		}
+
+		pt, err := ReadParkTable(file, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pt.NumEntries() != uint64(n) {
+			t.Fatalf("expected %d line points, got %d", n, pt.NumEntries())
+		}
+		if pt.Size() != wrote {
+			t.Fatalf("expected table size %d, got %d", wrote, pt.Size())
+		}
+		for i, expected := range linePoints {
+			got, err := pt.LinePoint(file, uint64(i))
+			if err != nil {
+				t.Fatalf("cannot read line point %d: %v", i, err)
+			}
+			if got != expected {
+				t.Fatalf("expected line point %d to be %+v, got %+v", i, expected, got)
+			}
+		}
+		if _, err := pt.LinePoint(file, uint64(n)); err == nil {
+			t.Fatal("expected an error when reading past the end of the table")
+		}
+	}
+}
+
+func TestCheckpointParks(t *testing.T) {
+	k := 20
+	r := rand.New(rand.NewSource(1))
+
+	n := 2*parameters.ParamC1 + 10
+	fxs := make([]uint64, n)
+	for i := range fxs {
+		fxs[i] = uint64(r.Intn(1 << (k + parameters.ParamEXT)))
+	}
+	sort.Slice(fxs, func(i, j int) bool { return fxs[i] < fxs[j] })
+
+	file, err := afero.NewMemMapFs().Create("TestCheckpointParks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteCheckpointParks(file, 0, k, fxs); err != nil {
+		t.Fatalf("cannot write %d outputs: %v", n, err)
+	}
+	pt, err := ReadParkTable(file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint64
+	for p := 0; p < 3; p++ {
+		values, err := pt.Park(file, p)
+		if err != nil {
+			t.Fatalf("cannot read park %d: %v", p, err)
+		}
+		for _, v := range values {
+			got = append(got, v.Lo)
+		}
+	}
+	if len(got) != n {
+		t.Fatalf("expected %d outputs, got %d", n, len(got))
+	}
+	for i := range fxs {
+		if got[i] != fxs[i] {
+			t.Fatalf("expected output %d to be %d, got %d", i, fxs[i], got[i])
+		}
+	}
+	if _, err := pt.Park(file, 3); err == nil {
+		t.Fatal("expected an error when reading past the last park")
+	}
+}
+
+func TestParkTableUnsorted(t *testing.T) {
+	file, err := afero.NewMemMapFs().Create("TestParkTableUnsorted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linePoints := []encoding.LinePoint{encoding.SquareToLinePoint(5, 1), encoding.SquareToLinePoint(3, 1)}
+	if _, err := WriteParkTable(file, 0, 16, linePoints); err == nil {
+		t.Fatal("expected an error when writing unsorted line points")
+	}
+}
@@ -3,9 +3,13 @@ package serialize
 import (
 	"errors"
 	"io"
+	"math/big"
 	"testing"
 
 	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
 )
 
 func fx(x uint64) uint64 {
@@ -22,7 +26,7 @@ func TestSerialize(t *testing.T) {
 
 	var wrote, entryLen int
 	for x := uint64(0); x < 100; x++ {
-		w, err := Write(file, int64(wrote), fx(x), &x, nil, nil, nil, k)
+		w, err := WriteText(file, int64(wrote), fx(x), &x, nil, nil, nil, k)
 		if err != nil {
 			t.Fatalf("cannot write x=%d: %v", x, err)
 		}
@@ -32,7 +36,7 @@ func TestSerialize(t *testing.T) {
 
 	var read int
 	for {
-		e, r, err := Read(file, int64(read), entryLen, k)
+		e, r, err := ReadText(file, int64(read), entryLen, k)
 		if errors.Is(err, io.EOF) {
 			break
 		}
@@ -45,3 +49,92 @@ func TestSerialize(t *testing.T) {
 		}
 	}
 }
+
+func TestSerializeBinary(t *testing.T) {
+	file, err := afero.NewMemMapFs().Create("TestSerializeBinary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := 30
+	x, pos, offset := uint64(1<<k-1), uint64(1<<(k+1)-1), uint64(1<<parameters.ParamOffsetSize-1)
+	collated := encoding.NewMetadata(1).Lsh(uint(2*k - 1))
+	// Collated values of table 3 span multiple words.
+	wide := encoding.MetadataFromBig(new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(CollaSize(4)*k)), big.NewInt(1)))
+	linePoint := encoding.SquareToLinePoint(pos, pos-1)
+
+	tests := []struct {
+		table int
+		entry *Entry
+	}{
+		{table: 1, entry: &Entry{Fx: fx(x), X: &x}},
+		{table: 2, entry: &Entry{Fx: fx(x), Pos: &pos, Offset: &offset, Collated: &collated}},
+		{table: 3, entry: &Entry{Fx: fx(x), Pos: &pos, Offset: &offset, Collated: &wide}},
+		{table: 6, entry: &Entry{Fx: 0, Pos: &pos, Offset: &offset, Collated: &encoding.Metadata{}}},
+		{table: 7, entry: &Entry{Fx: fx(x), Pos: &pos, Offset: &offset}},
+		{table: CheckpointTable, entry: &Entry{Fx: fx(x), Pos: &pos}},
+		{table: CompressedTable, entry: &Entry{Pos: &pos}},
+		{table: LinePointTable, entry: &Entry{LinePoint: &linePoint, Pos: &pos}},
+		{table: PositionTable, entry: &Entry{Pos: &pos, Offset: &offset, Index: 1<<(k+1) - 2}},
+	}
+
+	for _, tt := range tests {
+		wrote, err := Write(file, 0, tt.entry, k, tt.table)
+		if err != nil {
+			t.Fatalf("table %d: cannot write: %v", tt.table, err)
+		}
+		if wrote != EntrySize(k, tt.table) {
+			t.Fatalf("table %d: expected to write %d bytes, wrote %d", tt.table, EntrySize(k, tt.table), wrote)
+		}
+		eot, err := WriteEOT(file, int64(wrote), k, tt.table)
+		if err != nil {
+			t.Fatalf("table %d: cannot write EOT: %v", tt.table, err)
+		}
+
+		got, read, err := Read(file, 0, k, tt.table)
+		if err != nil {
+			t.Fatalf("table %d: cannot read: %v", tt.table, err)
+		}
+		if read != wrote {
+			t.Fatalf("table %d: expected to read %d bytes, read %d", tt.table, wrote, read)
+		}
+		if got.Fx != tt.entry.Fx {
+			t.Errorf("table %d: expected f(x)=%d, got %d", tt.table, tt.entry.Fx, got.Fx)
+		}
+		if (got.X == nil) != (tt.entry.X == nil) || got.X != nil && *got.X != *tt.entry.X {
+			t.Errorf("table %d: expected x=%v, got %v", tt.table, tt.entry.X, got.X)
+		}
+		if (got.Pos == nil) != (tt.entry.Pos == nil) || got.Pos != nil && *got.Pos != *tt.entry.Pos {
+			t.Errorf("table %d: expected pos=%v, got %v", tt.table, tt.entry.Pos, got.Pos)
+		}
+		if (got.Offset == nil) != (tt.entry.Offset == nil) || got.Offset != nil && *got.Offset != *tt.entry.Offset {
+			t.Errorf("table %d: expected offset=%v, got %v", tt.table, tt.entry.Offset, got.Offset)
+		}
+		if (got.Collated == nil) != (tt.entry.Collated == nil) || got.Collated != nil && *got.Collated != *tt.entry.Collated {
+			t.Errorf("table %d: expected collated=%v, got %v", tt.table, tt.entry.Collated, got.Collated)
+		}
+		if (got.LinePoint == nil) != (tt.entry.LinePoint == nil) || got.LinePoint != nil && *got.LinePoint != *tt.entry.LinePoint {
+			t.Errorf("table %d: expected line point=%v, got %v", tt.table, tt.entry.LinePoint, got.LinePoint)
+		}
+		if got.Index != tt.entry.Index {
+			t.Errorf("table %d: expected index=%d, got %d", tt.table, tt.entry.Index, got.Index)
+		}
+
+		if _, _, err := Read(file, int64(wrote), k, tt.table); !errors.Is(err, EOTErr) {
+			t.Errorf("table %d: expected EOT after %d bytes, got %v", tt.table, eot, err)
+		}
+	}
+}
+
+func TestSerializeBinaryOverflow(t *testing.T) {
+	file, err := afero.NewMemMapFs().Create("TestSerializeBinaryOverflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := 20
+	pos, offset := uint64(0), uint64(1<<parameters.ParamOffsetSize)
+	if _, err := Write(file, 0, &Entry{Fx: 1, Pos: &pos, Offset: &offset}, k, 7); err == nil {
+		t.Fatalf("expected an offset of %d to overflow", offset)
+	}
+}
@@ -0,0 +1,113 @@
+package bits
+
+// Writer packs values of arbitrary bit length into a byte slice.
+// Values are written most significant bit first, one after the
+// other, without any padding between them.
+type Writer struct {
+	buf []byte
+	// len tracks how many bits have been written so far
+	len int
+}
+
+// NewWriter returns a writer that can hold up to size bytes
+// without growing its underlying buffer.
+func NewWriter(size int) *Writer {
+	return &Writer{buf: make([]byte, 0, size)}
+}
+
+// WriteUint64 writes the n least significant bits of v.
+func (w *Writer) WriteUint64(v uint64, n int) {
+	for n > 0 {
+		if w.len/8 == len(w.buf) {
+			w.buf = append(w.buf, 0)
+		}
+		free := 8 - w.len%8
+		take := free
+		if n < take {
+			take = n
+		}
+		chunk := byte(v>>(n-take)) & byte(1<<take-1)
+		w.buf[w.len/8] |= chunk << (free - take)
+		w.len += take
+		n -= take
+	}
+}
+
+// WriteBytes writes the n least significant bits of b, where
+// b is a big-endian number such as the output of big.Int.Bytes.
+// If b is shorter than n bits, it is zero-padded.
+func (w *Writer) WriteBytes(b []byte, n int) {
+	size := ToBytes(n)
+	if len(b) > size {
+		b = b[len(b)-size:]
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	for i, c := range padded {
+		if i == 0 {
+			w.WriteUint64(uint64(c), n-(size-1)*8)
+			continue
+		}
+		w.WriteUint64(uint64(c), 8)
+	}
+}
+
+// Len returns the number of bits written.
+func (w *Writer) Len() int {
+	return w.len
+}
+
+// Bytes returns the written bits. Any bits left in the last
+// byte are zero.
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+// Reader reads values of arbitrary bit length out of a byte
+// slice written by a Writer.
+type Reader struct {
+	buf []byte
+	// pos tracks how many bits have been read so far
+	pos int
+}
+
+// NewReader returns a reader of the bits in b.
+func NewReader(b []byte) *Reader {
+	return &Reader{buf: b}
+}
+
+// ReadUint64 reads the next n bits, up to 64, as an unsigned integer.
+func (r *Reader) ReadUint64(n int) uint64 {
+	var v uint64
+	for n > 0 {
+		avail := 8 - r.pos%8
+		take := avail
+		if n < take {
+			take = n
+		}
+		chunk := (r.buf[r.pos/8] >> (avail - take)) & byte(1<<take-1)
+		v = v<<take | uint64(chunk)
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+// ReadBytes reads the next n bits and returns them as a big-endian
+// number of ToBytes(n) bytes, suitable for big.Int.SetBytes.
+func (r *Reader) ReadBytes(n int) []byte {
+	out := make([]byte, ToBytes(n))
+	for i := range out {
+		if i == 0 {
+			out[i] = byte(r.ReadUint64(n - (len(out)-1)*8))
+			continue
+		}
+		out[i] = byte(r.ReadUint64(8))
+	}
+	return out
+}
+
+// Skip advances the reader by n bits.
+func (r *Reader) Skip(n int) {
+	r.pos += n
+}
@@ -0,0 +1,36 @@
+package bits_test
+
+import (
+	"bytes"
+	"testing"
+
+	bitsutil "github.com/kargakis/chiapos/pkg/utils/bits"
+)
+
+func TestWriterReader(t *testing.T) {
+	w := bitsutil.NewWriter(0)
+	w.WriteUint64(0b101, 3)
+	w.WriteUint64(1<<63|1, 64)
+	w.WriteBytes([]byte{0x01, 0xff}, 12)
+	w.WriteUint64(0, 1)
+	w.WriteBytes([]byte{0x03}, 17)
+
+	if w.Len() != 3+64+12+1+17 {
+		t.Fatalf("expected %d bits to be written, got %d", 3+64+12+1+17, w.Len())
+	}
+
+	r := bitsutil.NewReader(w.Bytes())
+	if got := r.ReadUint64(3); got != 0b101 {
+		t.Errorf("expected %b, got %b", 0b101, got)
+	}
+	if got := r.ReadUint64(64); got != 1<<63|1 {
+		t.Errorf("expected %d, got %d", uint64(1<<63|1), got)
+	}
+	if got := r.ReadBytes(12); !bytes.Equal(got, []byte{0x01, 0xff}) {
+		t.Errorf("expected %x, got %x", []byte{0x01, 0xff}, got)
+	}
+	r.Skip(1)
+	if got := r.ReadBytes(17); !bytes.Equal(got, []byte{0, 0, 0x03}) {
+		t.Errorf("expected %x, got %x", []byte{0, 0, 0x03}, got)
+	}
+}
@@ -0,0 +1,173 @@
+package sort
+
+import (
+	"fmt"
+	mathbits "math/bits"
+	"sort"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+	bitsutil "github.com/kargakis/chiapos/pkg/utils/bits"
+)
+
+// maxBucketBits bounds the number of bucket files that are open
+// at the same time while sorting a table.
+const maxBucketBits = 10
+
+// bucket holds entries whose sort keys share the same most significant bits.
+type bucket struct {
+	file  afero.File
+	buf   []byte
+	count int
+}
+
+// add appends a serialized entry in the bucket, flushing the
+// bucket buffer to disk once it exceeds bufSize.
+func (b *bucket) add(entry []byte, bufSize int) error {
+	b.buf = append(b.buf, entry...)
+	b.count++
+	if len(b.buf) >= bufSize {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *bucket) flush() error {
+	_, err := b.file.Write(b.buf)
+	b.buf = b.buf[:0]
+	return err
+}
+
+// sortBuckets sorts a table that does not fit in memory. Sort keys are close
+// to uniformly distributed over their expected range, so entries are scattered
+// into buckets based on the most significant bits of their sort keys, and then
+// every bucket is sorted in memory and written back into file starting at
+// begin. Buckets that end up not fitting in memory are merge-sorted.
+func sortBuckets(file afero.File, fs afero.Fs, begin, numEntries, runEntries, k, t int, opts Options) error {
+	entryLen := serialize.EntrySize(k, t)
+	keyBits := sortKeyRange(k, t)
+	bits := bucketBits(numEntries, runEntries, keyBits)
+	if opts.Buckets > 0 && mathbits.TrailingZeros(uint(opts.Buckets)) < keyBits {
+		bits = mathbits.TrailingZeros(uint(opts.Buckets))
+	}
+
+	buckets := make([]*bucket, 1<<bits)
+	defer func() {
+		for _, b := range buckets {
+			if b != nil {
+				b.file.Close()
+				fs.Remove(b.file.Name())
+			}
+		}
+	}()
+	for i := range buckets {
+		bucketFile, err := tempFile(fs, opts.TempDir, file)
+		if err != nil {
+			return fmt.Errorf("cannot create bucket file: %w", err)
+		}
+		buckets[i] = &bucket{file: bucketFile}
+	}
+
+	bufSize := opts.AvailableMemory / len(buckets)
+	if bufSize > ioBufferSize {
+		bufSize = ioBufferSize
+	}
+	if bufSize < entryLen {
+		bufSize = entryLen
+	}
+
+	chunk := make([]byte, (ioBufferSize/entryLen+1)*entryLen)
+	for scattered := 0; scattered < numEntries; {
+		n := len(chunk) / entryLen
+		if numEntries-scattered < n {
+			n = numEntries - scattered
+		}
+		buf := chunk[:n*entryLen]
+		if _, err := file.ReadAt(buf, int64(begin+scattered*entryLen)); err != nil {
+			return fmt.Errorf("cannot read entries: %w", err)
+		}
+		for i := 0; i < len(buf); i += entryLen {
+			entry := buf[i : i+entryLen]
+			if err := buckets[bucketIndex(entry, k, t, keyBits, bits)].add(entry, bufSize); err != nil {
+				return fmt.Errorf("cannot write to bucket: %w", err)
+			}
+		}
+		scattered += n
+	}
+
+	offset := begin
+	for i, b := range buckets {
+		if err := b.flush(); err != nil {
+			return fmt.Errorf("cannot write to bucket: %w", err)
+		}
+		if err := sortBucket(file, fs, b, offset, runEntries, k, t, opts); err != nil {
+			return fmt.Errorf("cannot sort bucket %d: %w", i, err)
+		}
+		offset += b.count * entryLen
+
+		// Sorted buckets are no longer needed.
+		b.file.Close()
+		fs.Remove(b.file.Name())
+		buckets[i] = nil
+	}
+	return nil
+}
+
+// sortBucket sorts the entries of b and writes them in file at offset.
+func sortBucket(file afero.File, fs afero.Fs, b *bucket, offset, runEntries, k, t int, opts Options) error {
+	if b.count <= runEntries {
+		entries, err := loadEntries(b.file, 0, b.count, k, t)
+		if err != nil {
+			return err
+		}
+		sort.Sort(serialize.ByOutput{Entries: entries, TableIndex: t})
+		return writeEntries(file, offset, entries, k, t)
+	}
+
+	runs, err := createRuns(b.file, fs, opts.TempDir, 0, b.count, runEntries, k, t)
+	defer removeRuns(fs, runs)
+	if err != nil {
+		return err
+	}
+	return mergeRuns(file, runs, offset, mergeBufferSize(opts.AvailableMemory, len(runs), k, t), k, t)
+}
+
+// bucketBits returns the number of most significant bits of the sort keys
+// that should be used to pick a bucket, so that every bucket is expected
+// to fit in memory with room to spare for uneven distributions.
+func bucketBits(numEntries, runEntries, keyBits int) int {
+	bits := 1
+	for bits < maxBucketBits && bits < keyBits && numEntries>>bits > runEntries/2 {
+		bits++
+	}
+	return bits
+}
+
+// sortKeyRange returns the number of least significant bits the sort keys of
+// entries of table t are expected to be uniformly distributed over. Outputs
+// span all their bits. Positions point in tables of about 2^k entries, and
+// line points are made of two such positions, or of two x values, so they
+// are below 2^(2k-1).
+func sortKeyRange(k, t int) int {
+	switch t {
+	case serialize.LinePointTable:
+		return 2*k - 1
+	case serialize.PositionTable:
+		return k
+	}
+	return serialize.SortKeyBits(k, t)
+}
+
+// bucketIndex returns which of the 2^bits buckets the entry of table t falls
+// in, out of the most significant of the keyBits least significant bits of
+// its sort key. Entries with larger sort keys fall in the last bucket.
+func bucketIndex(entry []byte, k, t, keyBits, bits int) uint64 {
+	// Every entry starts with its sort key so there is no need
+	// to deserialize the whole entry.
+	r := bitsutil.NewReader(entry)
+	if r.ReadUint64(serialize.SortKeyBits(k, t)-keyBits) != 0 {
+		return 1<<bits - 1
+	}
+	return r.ReadUint64(bits)
+}
@@ -0,0 +1,161 @@
+package sort
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/serialize"
+)
+
+// sortExternal sorts a table that does not fit in memory. The table is
+// split into runs of at most runEntries entries, each run is sorted in
+// memory and persisted in a temporary file, and then all runs are merged
+// back into file starting at begin.
+func sortExternal(file afero.File, fs afero.Fs, begin, numEntries, runEntries, k, t int, opts Options) error {
+	runs, err := createRuns(file, fs, opts.TempDir, begin, numEntries, runEntries, k, t)
+	defer removeRuns(fs, runs)
+	if err != nil {
+		return err
+	}
+	return mergeRuns(file, runs, begin, mergeBufferSize(opts.AvailableMemory, len(runs), k, t), k, t)
+}
+
+// createRuns splits numEntries entries of table t found in src at begin
+// into sorted runs of at most runEntries entries each. Runs are stored in
+// temporary files in dir and should be removed with removeRuns once they
+// are no longer needed, even if an error is returned.
+func createRuns(src afero.File, fs afero.Fs, dir string, begin, numEntries, runEntries, k, t int) ([]*run, error) {
+	entryLen := serialize.EntrySize(k, t)
+
+	var runs []*run
+	for sorted := 0; sorted < numEntries; sorted += runEntries {
+		n := runEntries
+		if numEntries-sorted < n {
+			n = numEntries - sorted
+		}
+		entries, err := loadEntries(src, begin+sorted*entryLen, n, k, t)
+		if err != nil {
+			return runs, fmt.Errorf("cannot load run in memory: %w", err)
+		}
+		sort.Sort(serialize.ByOutput{Entries: entries, TableIndex: t})
+
+		runFile, err := tempFile(fs, dir, src)
+		if err != nil {
+			return runs, fmt.Errorf("cannot create run file: %w", err)
+		}
+		runs = append(runs, &run{file: runFile, remaining: len(entries)})
+		if err := writeEntries(runFile, 0, entries, k, t); err != nil {
+			return runs, fmt.Errorf("cannot write run: %w", err)
+		}
+	}
+	return runs, nil
+}
+
+// removeRuns closes and removes the files backing runs.
+func removeRuns(fs afero.Fs, runs []*run) {
+	for _, r := range runs {
+		r.file.Close()
+		fs.Remove(r.file.Name())
+	}
+}
+
+// tempFile creates a temporary file in dir named after file.
+func tempFile(fs afero.Fs, dir string, file afero.File) (afero.File, error) {
+	return afero.TempFile(fs, dir, filepath.Base(file.Name())+".sort-")
+}
+
+// mergeBufferSize returns the size of the read buffer of every run
+// so that all runs can be merged within availableMemory.
+func mergeBufferSize(availableMemory, numRuns, k, t int) int {
+	bufSize := availableMemory / (numRuns + 1)
+	if bufSize > ioBufferSize {
+		bufSize = ioBufferSize
+	}
+	if entryLen := serialize.EntrySize(k, t); bufSize < entryLen {
+		bufSize = entryLen
+	}
+	return bufSize
+}
+
+// run is a sorted part of a table persisted in a temporary file.
+type run struct {
+	file      afero.File
+	reader    *bufio.Reader
+	remaining int
+	// head is the smallest entry of the run that has not been merged yet.
+	head *serialize.Entry
+}
+
+// next advances head to the next entry of the run. It returns
+// io.EOF once all entries of the run are consumed.
+func (r *run) next(k, t int) error {
+	if r.remaining == 0 {
+		return io.EOF
+	}
+	buf := make([]byte, serialize.EntrySize(k, t))
+	if _, err := io.ReadFull(r.reader, buf); err != nil {
+		return err
+	}
+	entry, err := serialize.Decode(buf, k, t)
+	if err != nil {
+		return err
+	}
+	r.head = entry
+	r.remaining--
+	return nil
+}
+
+// runHeap is a min-heap of runs ordered by their head entries.
+type runHeap struct {
+	runs []*run
+	t    int
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+func (h *runHeap) Less(i, j int) bool {
+	return serialize.OutputLess(h.runs[i].head, h.runs[j].head, h.t)
+}
+func (h *runHeap) Swap(i, j int)      { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
+
+// mergeRuns performs a k-way merge of the provided runs and writes
+// the merged entries in file starting at begin.
+func mergeRuns(file afero.File, runs []*run, begin, bufSize, k, t int) error {
+	h := &runHeap{t: t}
+	for _, r := range runs {
+		r.reader = bufio.NewReaderSize(io.NewSectionReader(r.file, 0, int64(r.remaining*serialize.EntrySize(k, t))), bufSize)
+		if err := r.next(k, t); err != nil {
+			return fmt.Errorf("cannot read run: %w", err)
+		}
+		h.runs = append(h.runs, r)
+	}
+	heap.Init(h)
+
+	ew := serialize.NewEntryWriter(file, int64(begin), k, t)
+	for h.Len() > 0 {
+		r := h.runs[0]
+		if err := ew.Write(r.head); err != nil {
+			return fmt.Errorf("cannot write merged entry: %w", err)
+		}
+		switch err := r.next(k, t); err {
+		case nil:
+			heap.Fix(h, 0)
+		case io.EOF:
+			heap.Pop(h)
+		default:
+			return fmt.Errorf("cannot read run: %w", err)
+		}
+	}
+	return ew.Flush()
+}
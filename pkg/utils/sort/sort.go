@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path/filepath"
 	"sort"
 
 	"github.com/spf13/afero"
@@ -11,47 +12,126 @@ import (
 	"github.com/kargakis/chiapos/pkg/serialize"
 )
 
+const (
+	// entryMemory is a rough estimate of the memory a deserialized
+	// entry occupies, including the values it points to.
+	entryMemory = 256
+
+	// ioBufferSize is the maximum size of the buffers used to stream
+	// entries in and out of disk.
+	ioBufferSize = 1 << 20
+)
+
+const (
+	// MergeStrategy sorts tables that do not fit in memory by merging
+	// sorted runs of the table.
+	MergeStrategy = "merge"
+	// BucketStrategy sorts tables that do not fit in memory by scattering
+	// entries into buckets based on the most significant bits of their
+	// sort keys and then sorting every bucket in memory.
+	BucketStrategy = "bucket"
+)
+
+var supportedStrategies = []string{MergeStrategy, BucketStrategy}
+
+// Options configures how tables get sorted.
+type Options struct {
+	// AvailableMemory is the memory in bytes in which sorting can be done.
+	AvailableMemory int
+	// Strategy is the strategy used to sort tables that do not fit
+	// in memory. Defaults to MergeStrategy.
+	Strategy string
+	// Buckets is the number of buckets BucketStrategy scatters entries
+	// into. It needs to be a power of two, and when zero it is picked
+	// so that every bucket is expected to fit in memory.
+	Buckets int
+	// TempDir is the directory temporary files are created in. Defaults
+	// to the directory of the file being sorted.
+	TempDir string
+}
+
 // OnDisk performs sorting on the given file on disk, given begin which
-// is the start of the data in the file in need of sorting, and availableMemory
-// is the available memory in which sorting can be done.
-func OnDisk(file afero.File, fs afero.Fs, begin, tableSize, availableMemory, k, t int) error {
+// is the start of the data in the file in need of sorting. If the table
+// does not fit in the available memory, it is sorted using the strategy
+// in opts with the help of temporary files in fs.
+func OnDisk(file afero.File, fs afero.Fs, begin, tableSize, k, t int, opts Options) error {
+	if opts.Strategy == "" {
+		opts.Strategy = MergeStrategy
+	}
+	if opts.Strategy != MergeStrategy && opts.Strategy != BucketStrategy {
+		return fmt.Errorf("unknown sort strategy provided: %s (supported strategies: %v)", opts.Strategy, supportedStrategies)
+	}
+	if opts.Buckets != 0 && (opts.Buckets < 2 || opts.Buckets > 1<<maxBucketBits || opts.Buckets&(opts.Buckets-1) != 0) {
+		return fmt.Errorf("invalid number of buckets %d: needs to be a power of two between 2 and %d", opts.Buckets, 1<<maxBucketBits)
+	}
+	if opts.TempDir == "" {
+		opts.TempDir = filepath.Dir(file.Name())
+	}
+
 	entryLen := serialize.EntrySize(k, t)
+	// The table size includes the EOT entry which does not need sorting.
+	numEntries := tableSize/entryLen - 1
 
-	// TODO: Implement sort on disk (https://github.com/kargakis/chiapos/issues/5)
-	return sortInMemory(file, begin, entryLen, k, t)
+	runEntries := opts.AvailableMemory / (entryMemory + entryLen)
+	if runEntries < 2 {
+		return fmt.Errorf("not enough memory to sort table %d: %d bytes available", t, opts.AvailableMemory)
+	}
+	if numEntries <= runEntries {
+		return sortInMemory(file, begin, numEntries, k, t)
+	}
+
+	if opts.Strategy == BucketStrategy {
+		return sortBuckets(file, fs, begin, numEntries, runEntries, k, t, opts)
+	}
+	return sortExternal(file, fs, begin, numEntries, runEntries, k, t, opts)
 }
 
-func loadEntries(file afero.File, begin, entryLen, k int) (entries []*serialize.Entry, read int, err error) {
-	for {
-		entry, readLen, err := serialize.Read(file, int64(begin+read), entryLen, k)
-		if errors.Is(err, serialize.EOTErr) || errors.Is(err, io.EOF) {
-			return entries, read + readLen, nil
+// loadEntries reads up to n entries of table t found at begin. Reading stops
+// early if an EOT entry is found.
+func loadEntries(file afero.File, begin, n, k, t int) ([]*serialize.Entry, error) {
+	entryLen := serialize.EntrySize(k, t)
+	buf := make([]byte, n*entryLen)
+	read, err := file.ReadAt(buf, int64(begin))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	entries := make([]*serialize.Entry, 0, read/entryLen)
+	for i := 0; i+entryLen <= read; i += entryLen {
+		entry, err := serialize.Decode(buf[i:i+entryLen], k, t)
+		if errors.Is(err, serialize.EOTErr) {
+			break
 		}
 		if err != nil {
-			return entries, read + readLen, err
+			return nil, err
 		}
-		read += readLen
 		entries = append(entries, entry)
 	}
+	return entries, nil
 }
 
 // sortInMemory sorts a table in memory.
-func sortInMemory(file afero.File, begin, entryLen int, k, t int) error {
-	entries, _, err := loadEntries(file, begin, entryLen, k)
+func sortInMemory(file afero.File, begin, numEntries, k, t int) error {
+	entries, err := loadEntries(file, begin, numEntries, k, t)
 	if err != nil {
 		return fmt.Errorf("cannot load entries in memory: %w", err)
 	}
 
 	sort.Sort(serialize.ByOutput{Entries: entries, TableIndex: t})
 
-	var wrote int
+	if err := writeEntries(file, begin, entries, k, t); err != nil {
+		return fmt.Errorf("cannot write sorted values: %w", err)
+	}
+	return nil
+}
+
+// writeEntries writes entries one after the other starting at begin.
+func writeEntries(w io.WriterAt, begin int, entries []*serialize.Entry, k, t int) error {
+	ew := serialize.NewEntryWriter(w, int64(begin), k, t)
 	for _, e := range entries {
-		n, err := serialize.Write(file, int64(begin+wrote), e.Fx, e.X, e.Pos, e.Offset, e.Collated, k)
-		if err != nil {
-			return fmt.Errorf("cannot write sorted values: %w", err)
+		if err := ew.Write(e); err != nil {
+			return err
 		}
-		wrote += n
 	}
-
-	return nil
+	return ew.Flush()
 }
@@ -0,0 +1,235 @@
+package sort
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/kargakis/chiapos/pkg/encoding"
+	"github.com/kargakis/chiapos/pkg/parameters"
+	"github.com/kargakis/chiapos/pkg/serialize"
+)
+
+func TestOnDisk(t *testing.T) {
+	k := 16
+	numEntries := 1000
+
+	tests := []struct {
+		name            string
+		table           int
+		availableMemory int
+		strategy        string
+		buckets         int
+		tempDir         string
+		// fxBits is the number of bits outputs are randomly
+		// distributed over. Few bits result in plenty of ties
+		// that need to be broken by positions and offsets.
+		fxBits int
+	}{
+		{
+			name:            "table 1 in memory",
+			table:           1,
+			availableMemory: 1 << 30,
+			strategy:        MergeStrategy,
+			fxBits:          8,
+		},
+		{
+			name:            "table 1 in multiple runs",
+			table:           1,
+			availableMemory: 50 * (entryMemory + serialize.EntrySize(k, 1)),
+			strategy:        MergeStrategy,
+			fxBits:          8,
+		},
+		{
+			name:            "table 2 in memory",
+			table:           2,
+			availableMemory: 1 << 30,
+			strategy:        MergeStrategy,
+			fxBits:          8,
+		},
+		{
+			name:            "table 2 in multiple runs",
+			table:           2,
+			availableMemory: 64 * (entryMemory + serialize.EntrySize(k, 2)),
+			strategy:        MergeStrategy,
+			fxBits:          8,
+		},
+		{
+			name:            "table 2 in multiple runs in a temporary directory",
+			table:           2,
+			availableMemory: 64 * (entryMemory + serialize.EntrySize(k, 2)),
+			strategy:        MergeStrategy,
+			tempDir:         "/tmp",
+			fxBits:          8,
+		},
+		{
+			name:            "table 1 in buckets",
+			table:           1,
+			availableMemory: 50 * (entryMemory + serialize.EntrySize(k, 1)),
+			strategy:        BucketStrategy,
+			fxBits:          k + parameters.ParamEXT,
+		},
+		{
+			name:            "table 1 in a fixed number of buckets",
+			table:           1,
+			availableMemory: 50 * (entryMemory + serialize.EntrySize(k, 1)),
+			strategy:        BucketStrategy,
+			buckets:         8,
+			fxBits:          k + parameters.ParamEXT,
+		},
+		{
+			name:            "table 2 in buckets",
+			table:           2,
+			availableMemory: 64 * (entryMemory + serialize.EntrySize(k, 2)),
+			strategy:        BucketStrategy,
+			fxBits:          k + parameters.ParamEXT,
+		},
+		{
+			name:            "table 2 in buckets that do not fit in memory",
+			table:           2,
+			availableMemory: 64 * (entryMemory + serialize.EntrySize(k, 2)),
+			strategy:        BucketStrategy,
+			fxBits:          8,
+		},
+		{
+			name:            "line points in buckets",
+			table:           serialize.LinePointTable,
+			availableMemory: 64 * (entryMemory + serialize.EntrySize(k, serialize.LinePointTable)),
+			strategy:        BucketStrategy,
+		},
+		{
+			name:            "positions in buckets",
+			table:           serialize.PositionTable,
+			availableMemory: 64 * (entryMemory + serialize.EntrySize(k, serialize.PositionTable)),
+			strategy:        BucketStrategy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			file, err := fs.Create("/plots/plot.dat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.MkdirAll("/tmp", 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			r := rand.New(rand.NewSource(int64(tt.table)))
+			begin := 10
+			var wrote int
+			counts := make(map[interface{}]int)
+			for i := 0; i < numEntries; i++ {
+				e := &serialize.Entry{Index: i}
+				switch tt.table {
+				case 1:
+					x := uint64(i)
+					e.Fx, e.X = uint64(r.Int63n(1<<tt.fxBits)), &x
+				case serialize.LinePointTable:
+					// Line points of pairs of positions in a table of 2^k entries.
+					x, y := uint64(r.Intn(1<<k)), uint64(r.Intn(1<<k))
+					lp, pos := encoding.SquareToLinePoint(x, y), uint64(i)
+					e.LinePoint, e.Pos = &lp, &pos
+				case serialize.PositionTable:
+					// Some tables have more than 2^k entries.
+					pos, offset := uint64(r.Intn(1<<k+1<<(k-4))), uint64(r.Intn(64))
+					e.Pos, e.Offset = &pos, &offset
+				default:
+					pos, offset := uint64(r.Intn(numEntries)), uint64(r.Intn(64))
+					collated := encoding.NewMetadata(uint64(i))
+					e.Fx, e.Pos, e.Offset, e.Collated = uint64(r.Int63n(1<<tt.fxBits)), &pos, &offset, &collated
+				}
+				counts[sortKey(e, tt.table)]++
+				w, err := serialize.Write(file, int64(begin+wrote), e, k, tt.table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wrote += w
+			}
+			w, err := serialize.WriteEOT(file, int64(begin+wrote), k, tt.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wrote += w
+
+			opts := Options{AvailableMemory: tt.availableMemory, Strategy: tt.strategy, Buckets: tt.buckets, TempDir: tt.tempDir}
+			if err := OnDisk(file, fs, begin, wrote, k, tt.table, opts); err != nil {
+				t.Fatalf("cannot sort: %v", err)
+			}
+
+			entries, err := loadEntries(file, begin, numEntries+1, k, tt.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != numEntries {
+				t.Fatalf("expected %d entries, got %d", numEntries, len(entries))
+			}
+			for i, e := range entries {
+				counts[sortKey(e, tt.table)]--
+				if i > 0 && serialize.OutputLess(e, entries[i-1], tt.table) {
+					t.Fatalf("entry %d is smaller than entry %d", i, i-1)
+				}
+			}
+			for key, count := range counts {
+				if count != 0 {
+					t.Fatalf("unexpected number of entries with sort key %v: %d", key, count)
+				}
+			}
+			if _, _, err := serialize.Read(file, int64(begin+wrote-serialize.EntrySize(k, tt.table)), k, tt.table); !errors.Is(err, serialize.EOTErr) {
+				t.Fatalf("expected EOT at the end of the table, got %v", err)
+			}
+
+			files, err := afero.ReadDir(fs, "/plots")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 {
+				t.Fatalf("expected temporary files to be removed, found %d files", len(files))
+			}
+			if files, err = afero.ReadDir(fs, "/tmp"); err != nil || len(files) != 0 {
+				t.Fatalf("expected temporary files to be removed, found %d files (%v)", len(files), err)
+			}
+		})
+	}
+}
+
+// sortKey returns the field entries of table t are sorted by first.
+func sortKey(e *serialize.Entry, t int) interface{} {
+	switch t {
+	case serialize.LinePointTable:
+		return *e.LinePoint
+	case serialize.PositionTable:
+		return *e.Pos
+	}
+	return e.Fx
+}
+
+func TestBucketIndex(t *testing.T) {
+	k, bits, numEntries := 16, 4, 1<<14
+	r := rand.New(rand.NewSource(1))
+
+	for _, table := range []int{1, serialize.LinePointTable, serialize.PositionTable} {
+		counts := make([]int, 1<<bits)
+		for i := 0; i < numEntries; i++ {
+			// Positions and line points point in a table of 2^k entries.
+			x, pos, offset := uint64(i), uint64(r.Intn(1<<k)), uint64(0)
+			lp := encoding.SquareToLinePoint(uint64(r.Intn(1<<k)), uint64(r.Intn(1<<k)))
+			e := &serialize.Entry{Fx: uint64(r.Int63n(1 << (k + parameters.ParamEXT))), X: &x, LinePoint: &lp, Pos: &pos, Offset: &offset}
+			entry, err := serialize.Encode(e, k, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[bucketIndex(entry, k, table, sortKeyRange(k, table), bits)]++
+		}
+		// Every bucket is expected to hold about the same number of entries.
+		expected := numEntries >> bits
+		for i, count := range counts {
+			if count < expected/2 || count > expected*2 {
+				t.Errorf("table %d: expected about %d entries in bucket %d, got %d", table, expected, i, count)
+			}
+		}
+	}
+}
@@ -25,21 +25,6 @@ func Concat(k uint64, xs ...uint64) *big.Int {
 	return res
 }
 
-// ConcatBig performs zero-padded concatenation of the provided xs.
-func ConcatBig(k int, xs ...*big.Int) *big.Int {
-	switch len(xs) {
-	case 0:
-		return big.NewInt(0)
-	case 1:
-		return xs[0]
-	}
-	res := big.NewInt(0)
-	for _, x := range xs {
-		res.Lsh(res, uint(k)).Add(res, x)
-	}
-	return res
-}
-
 // ConcatExtended shifts x paramEXT bits to the left, then adds
 // y % paramM to it.
 func ConcatExtended(x, y uint64) uint64 {